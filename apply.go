@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Apply policies decide what happens when the config of a running server
+// changes
+const (
+	applyManual  = "manual"  // keep running the old config until applied by hand
+	applyRestart = "restart" // restart frpc
+	applyReload  = "reload"  // hot-reload through the frpc admin API
+)
+
+// Applier compares running servers with their current config and applies
+// pending changes according to each server's policy
+type Applier struct {
+	config  *ConfigManager
+	process *ProcessManager
+	pending chan struct{} // holds a request for ApplyPending, see Schedule
+	mu      sync.Mutex    // serializes restarts and reloads
+}
+
+func NewApplier(config *ConfigManager, process *ProcessManager) *Applier {
+	return &Applier{config: config, process: process, pending: make(chan struct{}, 1)}
+}
+
+// Schedule asks Run to apply pending changes without waiting for it.
+// Requests made while one is queued are merged into it, since a run always
+// applies the latest config.
+func (a *Applier) Schedule() {
+	select {
+	case a.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Run applies pending changes whenever they are scheduled, one run at a time
+func (a *Applier) Run() {
+	for range a.pending {
+		a.ApplyPending()
+	}
+}
+
+// Pending returns the running and the pending config of a server. dirty
+// reports whether a running server's config differs from its current
+// settings.
+func (a *Applier) Pending(server *ServerConfig) (running, pending string, dirty bool) {
+	pending = a.config.GenerateToml(server)
+	running, ok := a.process.RunningToml(server.ID)
+	return running, pending, ok && running != pending
+}
+
+// Apply makes a running server use its current config. Reloads fall back
+// to a restart when global settings changed or frpc rejects the reload.
+// It returns the mode that was used.
+func (a *Applier) Apply(server *ServerConfig, mode string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	running, pending, dirty := a.Pending(server)
+	if !dirty {
+		return "", nil
+	}
+	if err := a.config.CheckRunnable(server); err != nil {
+		return "", err
+	}
+
+	if mode == applyReload {
+		if tomlGlobals(running) != tomlGlobals(pending) {
+			log.Printf("Server %s: global settings changed, restarting instead of reloading", server.Name)
+		} else if err := a.process.Reload(server.ID, pending); err != nil {
+			log.Printf("Server %s: %v; restarting instead", server.Name, err)
+		} else {
+			return applyReload, nil
+		}
+	}
+	if err := restartServer(a.config, a.process, server); err != nil {
+		return "", err
+	}
+	return applyRestart, nil
+}
+
+// ApplyPending applies pending changes of running servers whose policy is
+// not manual
+func (a *Applier) ApplyPending() {
+	servers, err := a.config.Load()
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return
+	}
+	for i := range servers {
+		s := &servers[i]
+		if s.ApplyPolicy != applyRestart && s.ApplyPolicy != applyReload {
+			continue
+		}
+		mode, err := a.Apply(s, s.ApplyPolicy)
+		if err != nil {
+			log.Printf("Failed to apply config to server %s: %v", s.Name, err)
+			continue
+		}
+		if mode != "" {
+			log.Printf("Applied config changes to server %s (%s)", s.Name, mode)
+		}
+	}
+}
+
+// RestartReport lists what RestartChanged did
+type RestartReport struct {
+	Restarted []string `json:"restarted"`
+	Stopped   []string `json:"stopped"`
+	Errors    []string `json:"errors"`
+}
+
+// RestartChanged brings running servers in line with a config change
+// regardless of their policy: servers running an outdated config are
+// restarted and removed ones stopped
+func (a *Applier) RestartChanged(before, after []ServerConfig) *RestartReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	report := &RestartReport{Restarted: []string{}, Stopped: []string{}, Errors: []string{}}
+	next := make(map[string]*ServerConfig, len(after))
+	for i := range after {
+		next[after[i].ID] = &after[i]
+	}
+	for i := range before {
+		old := &before[i]
+		if running, _ := a.process.Status(old.ID); !running {
+			continue
+		}
+		s, ok := next[old.ID]
+		if !ok {
+			a.process.Stop(old.ID)
+			report.Stopped = append(report.Stopped, old.Name)
+			continue
+		}
+		if _, _, dirty := a.Pending(s); !dirty {
+			continue
+		}
+		if err := restartServer(a.config, a.process, s); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", s.Name, err))
+			continue
+		}
+		report.Restarted = append(report.Restarted, s.Name)
+	}
+	return report
+}
+
+// StopRemoved stops running servers of before that are not in after and
+// returns their names
+func (a *Applier) StopRemoved(before, after []ServerConfig) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	next := make(map[string]bool, len(after))
+	for _, s := range after {
+		next[s.ID] = true
+	}
+	var stopped []string
+	for _, s := range before {
+		if running, _ := a.process.Status(s.ID); running && !next[s.ID] {
+			a.process.Stop(s.ID)
+			stopped = append(stopped, s.Name)
+		}
+	}
+	return stopped
+}
+
+// tomlGlobals returns the part of a generated config before the proxies,
+// which frpc cannot reload
+func tomlGlobals(toml string) string {
+	if i := strings.Index(toml, "\n[[proxies]]"); i >= 0 {
+		return toml[:i]
+	}
+	return toml
+}
+
+// maskToml hides the auth token and the given secret values in generated
+// config shown to users. Longer values are replaced first, so that a secret
+// containing another is not left partly visible.
+func maskToml(toml string, secrets []string) string {
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, s := range secrets {
+		toml = strings.ReplaceAll(toml, s, "******")
+	}
+	lines := strings.Split(toml, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, "token = ") {
+			lines[i] = fmt.Sprintf("token = %q", "******")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -63,17 +65,13 @@ func (am *AuthManager) Setup(password string) error {
 		return err
 	}
 
-	return os.WriteFile(am.authFilePath(), b, 0600)
+	return writeJSONFile(am.authFilePath(), b, 0600)
 }
 
 func (am *AuthManager) Verify(password string) bool {
-	b, err := os.ReadFile(am.authFilePath())
-	if err != nil {
-		return false
-	}
-
 	var data AuthData
-	if err := json.Unmarshal(b, &data); err != nil {
+	if err := readJSONFile(am.authFilePath(), &data); err != nil {
+		log.Printf("Failed to read auth data: %v", err)
 		return false
 	}
 
@@ -122,10 +120,28 @@ func (am *AuthManager) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), actorKey{}, sessionActor(token))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+type actorKey struct{}
+
+// sessionActor identifies a session in history records without exposing
+// the session token itself
+func sessionActor(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "session:" + hex.EncodeToString(sum[:4])
+}
+
+// requestActor returns who is making an authenticated request
+func requestActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return "api"
+}
+
 func hashPassword(password, salt string) string {
 	h := sha256.New()
 	h.Write([]byte(salt + password))
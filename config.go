@@ -3,9 +3,10 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,11 +20,24 @@ type ServerConfig struct {
 	AuthToken  string        `json:"authToken,omitempty"`
 	AuthMethod string        `json:"authMethod,omitempty"`
 	TLSEnable  bool          `json:"tlsEnable,omitempty"`
+	Protocol   string        `json:"protocol,omitempty"` // tcp, kcp, quic, websocket, wss
 	User       string        `json:"user,omitempty"`
 	AutoStart  *bool         `json:"autoStart"`
 	Proxies    []ProxyConfig `json:"proxies"`
 	CreatedAt  string        `json:"createdAt"`
 	UpdatedAt  string        `json:"updatedAt"`
+	Revision   int64         `json:"revision"` // bumped on every change, including proxies
+
+	// ApplyPolicy decides how changes reach a running frpc: manual (default),
+	// restart or reload
+	ApplyPolicy string `json:"applyPolicy,omitempty"`
+
+	// RestartPolicy decides whether frpc is restarted when it exits on its
+	// own: never, on-failure (default) or always. MaxRestarts limits
+	// consecutive restarts before the server is left in crash-loop state;
+	// 0 means defaultMaxRestarts.
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	MaxRestarts   int    `json:"maxRestarts,omitempty"`
 }
 
 type ProxyConfig struct {
@@ -35,71 +49,337 @@ type ProxyConfig struct {
 	RemotePort    int      `json:"remotePort,omitempty"`
 	CustomDomains []string `json:"customDomains,omitempty"`
 	Subdomain     string   `json:"subdomain,omitempty"`
+	Source        string   `json:"source,omitempty"` // set when managed by an integration, e.g. "docker:web"
+	Revision      int64    `json:"revision"`
 }
 
+// errRevisionMismatch is returned when a change was based on a stale revision
+var errRevisionMismatch = errors.New("modified by someone else, reload and try again")
+
+// errNotFound is returned for a server or proxy ID that does not exist
+var errNotFound = errors.New("not found")
+
+// State is the complete configuration managed by ConfigManager
+type State struct {
+	Servers []ServerConfig
+}
+
+// ConfigManager owns servers.json. The decrypted state is cached in memory;
+// all changes go through Update so concurrent requests cannot lose each
+// other's edits.
 type ConfigManager struct {
-	dataDir string
+	store   Storage
+	secrets *SecretStore
+	vars    *VariableStore
+	history *HistoryManager
+	state   *State // nil until first loaded
 	mu      sync.RWMutex
-}
 
-func NewConfigManager(dataDir string) *ConfigManager {
-	return &ConfigManager{dataDir: dataDir}
+	// onCommit runs after every saved change, outside the lock. It must not
+	// block, since it runs on the request that made the change.
+	onCommit func()
+
+	// sealedTokens maps plain tokens to their stored form, so saving an
+	// unchanged server does not produce a new ciphertext
+	sealedTokens map[string]string
+
+	// expandEnvs makes GenerateToml resolve {{ .Envs.NAME }} itself instead
+	// of leaving it for frpc
+	expandEnvs bool
 }
 
-func (cm *ConfigManager) configFilePath() string {
-	return filepath.Join(cm.dataDir, "servers.json")
+func NewConfigManager(store Storage, secrets *SecretStore, vars *VariableStore, history *HistoryManager) *ConfigManager {
+	return &ConfigManager{store: store, secrets: secrets, vars: vars, history: history, sealedTokens: make(map[string]string)}
 }
 
+// Load returns a copy of all servers
 func (cm *ConfigManager) Load() ([]ServerConfig, error) {
 	cm.mu.RLock()
-	defer cm.mu.RUnlock()
+	if cm.state != nil {
+		servers := cloneServers(cm.state.Servers)
+		cm.mu.RUnlock()
+		return servers, nil
+	}
+	cm.mu.RUnlock()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if err := cm.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	return cloneServers(cm.state.Servers), nil
+}
 
-	b, err := os.ReadFile(cm.configFilePath())
+// ensureLoaded reads servers.json into the cache; callers hold the write lock
+func (cm *ConfigManager) ensureLoaded() error {
+	if cm.state != nil {
+		return nil
+	}
+	servers, err := cm.readFile()
+	if err != nil {
+		return err
+	}
+	cm.state = &State{Servers: servers}
+	return nil
+}
+
+func (cm *ConfigManager) readFile() ([]ServerConfig, error) {
+	servers, err := cm.store.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []ServerConfig{}, nil
-		}
 		return nil, err
 	}
+	stored := make([]string, len(servers))
+	for i := range servers {
+		stored[i] = servers[i].AuthToken
+	}
+	if err := cm.unseal(servers); err != nil {
+		return nil, err
+	}
+	for i := range servers {
+		if stored[i] != servers[i].AuthToken {
+			cm.sealedTokens[servers[i].AuthToken] = stored[i]
+		}
+	}
+	return servers, nil
+}
+
+// seal returns a copy of servers with secrets encrypted; callers hold the
+// write lock
+func (cm *ConfigManager) seal(servers []ServerConfig) ([]ServerConfig, error) {
+	sealed := make([]ServerConfig, len(servers))
+	copy(sealed, servers)
+	for i := range sealed {
+		plain := sealed[i].AuthToken
+		if plain == "" {
+			continue
+		}
+		token, ok := cm.sealedTokens[plain]
+		if !ok {
+			var err error
+			if token, err = cm.secrets.Encrypt(plain); err != nil {
+				return nil, err
+			}
+			cm.sealedTokens[plain] = token
+		}
+		sealed[i].AuthToken = token
+	}
+	return sealed, nil
+}
 
+// unseal decrypts the secrets of servers in place
+func (cm *ConfigManager) unseal(servers []ServerConfig) error {
+	for i := range servers {
+		token, err := cm.secrets.Decrypt(servers[i].AuthToken)
+		if err != nil {
+			return fmt.Errorf("server %s: %v", servers[i].Name, err)
+		}
+		servers[i].AuthToken = token
+	}
+	return nil
+}
+
+// Unseal decodes servers.json content, e.g. from a snapshot
+func (cm *ConfigManager) Unseal(b []byte) ([]ServerConfig, error) {
 	var servers []ServerConfig
 	if err := json.Unmarshal(b, &servers); err != nil {
 		return nil, err
 	}
-	return servers, nil
+	return servers, cm.unseal(servers)
 }
 
-func (cm *ConfigManager) Save(servers []ServerConfig) error {
+// Update runs fn against a copy of the state while holding the lock for
+// the whole read-modify-write cycle. If fn returns an error nothing is
+// saved.
+func (cm *ConfigManager) Update(fn func(*State) error) error {
+	return cm.UpdateAs("system", "", fn)
+}
+
+// UpdateAs is Update with the change attributed to actor in the history.
+// A non-empty note is prepended to the change summary.
+func (cm *ConfigManager) UpdateAs(actor, note string, fn func(*State) error) error {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	prev := cm.state
+	err := cm.update(actor, note, fn)
+	changed := cm.state != prev
+	cm.mu.Unlock()
 
-	b, err := json.MarshalIndent(servers, "", "  ")
-	if err != nil {
+	if err == nil && changed && cm.onCommit != nil {
+		cm.onCommit()
+	}
+	return err
+}
+
+func (cm *ConfigManager) update(actor, note string, fn func(*State) error) error {
+	if err := cm.ensureLoaded(); err != nil {
 		return err
 	}
-	return os.WriteFile(cm.configFilePath(), b, 0644)
+	next := &State{Servers: cloneServers(cm.state.Servers)}
+	if err := fn(next); err != nil {
+		return err
+	}
+	return cm.commit(actor, note, next)
 }
 
-func (cm *ConfigManager) GetServer(id string) (*ServerConfig, error) {
-	servers, err := cm.Load()
+// commit writes next to disk, records history and swaps the cache. Callers
+// hold the write lock. Unchanged state is not written.
+func (cm *ConfigManager) commit(actor, note string, next *State) error {
+	summary := summarizeChanges(cm.state.Servers, next.Servers)
+	if note != "" {
+		summary = append([]string{note}, summary...)
+	}
+	if len(summary) == 0 {
+		return nil
+	}
+
+	bumpRevisions(cm.state.Servers, next.Servers)
+	sealed, err := cm.seal(next.Servers)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for i := range servers {
-		if servers[i].ID == id {
-			return &servers[i], nil
+
+	// Keep the pre-history state so the first change can be rolled back
+	if len(summary) > 0 && cm.history.Empty() && len(cm.state.Servers) > 0 {
+		if prev, err := cm.seal(cm.state.Servers); err == nil {
+			cm.history.Record("system", []string{"initial state"}, prev)
 		}
 	}
-	return nil, fmt.Errorf("server not found: %s", id)
+
+	if err := cm.store.Save(sealed); err != nil {
+		return err
+	}
+	cm.state = next
+
+	if len(summary) > 0 {
+		cm.history.Record(actor, summary, sealed)
+	}
+	return nil
 }
 
-func (cm *ConfigManager) CreateServer(cfg ServerConfig) error {
-	servers, err := cm.Load()
+// RestartPolicy returns the effective restart policy and restart limit of
+// a server. Servers that no longer exist are never restarted.
+func (cm *ConfigManager) RestartPolicy(serverID string) (string, int) {
+	server, err := cm.GetServer(serverID)
 	if err != nil {
-		return err
+		return restartNever, 0
 	}
+	policy, maxRestarts := server.RestartPolicy, server.MaxRestarts
+	if policy == "" {
+		policy = restartOnFailure
+	}
+	if maxRestarts == 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+	return policy, maxRestarts
+}
+
+func (cm *ConfigManager) GetServer(id string) (*ServerConfig, error) {
+	cm.mu.RLock()
+	if cm.state == nil {
+		cm.mu.RUnlock()
+		if _, err := cm.Load(); err != nil {
+			return nil, err
+		}
+		cm.mu.RLock()
+	}
+	defer cm.mu.RUnlock()
+
+	for i := range cm.state.Servers {
+		if cm.state.Servers[i].ID == id {
+			s := cloneServers(cm.state.Servers[i : i+1])[0]
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("server %w: %s", errNotFound, id)
+}
+
+// bumpRevisions sets the revision of every server and proxy in next: one
+// past the previous revision if it changed, unchanged otherwise
+func bumpRevisions(prev, next []ServerConfig) {
+	old := make(map[string]*ServerConfig, len(prev))
+	for i := range prev {
+		old[prev[i].ID] = &prev[i]
+	}
+	for i := range next {
+		s := &next[i]
+		p, ok := old[s.ID]
+		if !ok {
+			s.Revision++
+			for j := range s.Proxies {
+				s.Proxies[j].Revision++
+			}
+			continue
+		}
+
+		oldProxies := make(map[string]ProxyConfig, len(p.Proxies))
+		for _, op := range p.Proxies {
+			oldProxies[op.ID] = op
+		}
+		for j := range s.Proxies {
+			px := &s.Proxies[j]
+			op, ok := oldProxies[px.ID]
+			switch {
+			case !ok:
+				px.Revision++
+			case len(changedFields(op, *px, "revision")) > 0:
+				px.Revision = op.Revision + 1
+			default:
+				px.Revision = op.Revision
+			}
+		}
 
+		if len(changedFields(*p, *s, "revision", "updatedAt")) > 0 {
+			s.Revision = p.Revision + 1
+		} else {
+			s.Revision = p.Revision
+		}
+	}
+}
+
+// cloneServers deep-copies servers so the cache is never shared
+func cloneServers(in []ServerConfig) []ServerConfig {
+	out := make([]ServerConfig, len(in))
+	for i, s := range in {
+		if s.AutoStart != nil {
+			v := *s.AutoStart
+			s.AutoStart = &v
+		}
+		proxies := make([]ProxyConfig, len(s.Proxies))
+		for j, p := range s.Proxies {
+			if p.CustomDomains != nil {
+				p.CustomDomains = append([]string{}, p.CustomDomains...)
+			}
+			proxies[j] = p
+		}
+		s.Proxies = proxies
+		out[i] = s
+	}
+	return out
+}
+
+// Server returns the server with the given ID for modification
+func (st *State) Server(id string) (*ServerConfig, error) {
+	for i := range st.Servers {
+		if st.Servers[i].ID == id {
+			return &st.Servers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("server %w: %s", errNotFound, id)
+}
+
+// Proxy returns the proxy with the given ID for modification
+func (s *ServerConfig) Proxy(id string) (*ProxyConfig, error) {
+	for i := range s.Proxies {
+		if s.Proxies[i].ID == id {
+			return &s.Proxies[i], nil
+		}
+	}
+	return nil, fmt.Errorf("proxy %w: %s", errNotFound, id)
+}
+
+// AddServer assigns an ID and timestamps to cfg and appends it
+func (st *State) AddServer(cfg ServerConfig) *ServerConfig {
 	cfg.ID = generateID()
+	cfg.Revision = 0
 	cfg.CreatedAt = time.Now().Format(time.RFC3339)
 	cfg.UpdatedAt = cfg.CreatedAt
 
@@ -111,107 +391,271 @@ func (cm *ConfigManager) CreateServer(cfg ServerConfig) error {
 		cfg.Proxies = []ProxyConfig{}
 	}
 
-	servers = append(servers, cfg)
-	return cm.Save(servers)
+	st.Servers = append(st.Servers, cfg)
+	return &st.Servers[len(st.Servers)-1]
 }
 
-func (cm *ConfigManager) UpdateServer(id string, cfg ServerConfig) error {
-	servers, err := cm.Load()
+// UpdateServer replaces a server's settings. AuthToken is write-only in the
+// API, so an empty token keeps the stored one unless clearAuthToken is set.
+func (st *State) UpdateServer(id string, cfg ServerConfig, clearAuthToken bool) error {
+	s, err := st.Server(id)
 	if err != nil {
 		return err
 	}
+	if cfg.AuthToken == "" && !clearAuthToken {
+		cfg.AuthToken = s.AuthToken
+	}
+	cfg.ID = id
+	cfg.CreatedAt = s.CreatedAt
+	cfg.UpdatedAt = time.Now().Format(time.RFC3339)
+	cfg.Proxies = s.Proxies
+	*s = cfg
+	return nil
+}
 
-	for i := range servers {
-		if servers[i].ID == id {
-			cfg.ID = id
-			cfg.CreatedAt = servers[i].CreatedAt
-			cfg.UpdatedAt = time.Now().Format(time.RFC3339)
-			cfg.Proxies = servers[i].Proxies
-			servers[i] = cfg
-			return cm.Save(servers)
+func (st *State) DeleteServer(id string) error {
+	for i := range st.Servers {
+		if st.Servers[i].ID == id {
+			st.Servers = append(st.Servers[:i], st.Servers[i+1:]...)
+			return nil
 		}
 	}
-	return fmt.Errorf("server not found: %s", id)
+	return fmt.Errorf("server %w: %s", errNotFound, id)
 }
 
-func (cm *ConfigManager) DeleteServer(id string) error {
-	servers, err := cm.Load()
+func (st *State) AddProxy(serverID string, proxy ProxyConfig) (*ProxyConfig, error) {
+	s, err := st.Server(serverID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	proxy.ID = generateID()
+	proxy.Revision = 0
+	s.Proxies = append(s.Proxies, proxy)
+	s.UpdatedAt = time.Now().Format(time.RFC3339)
+	return &s.Proxies[len(s.Proxies)-1], nil
+}
 
-	for i := range servers {
-		if servers[i].ID == id {
-			servers = append(servers[:i], servers[i+1:]...)
-			return cm.Save(servers)
-		}
+func (st *State) UpdateProxy(serverID, proxyID string, proxy ProxyConfig) error {
+	s, err := st.Server(serverID)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("server not found: %s", id)
+	p, err := s.Proxy(proxyID)
+	if err != nil {
+		return err
+	}
+	proxy.ID = proxyID
+	proxy.Source = p.Source
+	*p = proxy
+	s.UpdatedAt = time.Now().Format(time.RFC3339)
+	return nil
 }
 
-func (cm *ConfigManager) AddProxy(serverID string, proxy ProxyConfig) error {
-	servers, err := cm.Load()
+func (st *State) DeleteProxy(serverID, proxyID string) error {
+	s, err := st.Server(serverID)
 	if err != nil {
 		return err
 	}
+	for j := range s.Proxies {
+		if s.Proxies[j].ID == proxyID {
+			s.Proxies[j] = s.Proxies[len(s.Proxies)-1]
+			s.Proxies = s.Proxies[:len(s.Proxies)-1]
+			s.UpdatedAt = time.Now().Format(time.RFC3339)
+			return nil
+		}
+	}
+	return fmt.Errorf("proxy %w: %s", errNotFound, proxyID)
+}
 
-	for i := range servers {
-		if servers[i].ID == serverID {
-			proxy.ID = generateID()
-			servers[i].Proxies = append(servers[i].Proxies, proxy)
-			servers[i].UpdatedAt = time.Now().Format(time.RFC3339)
-			return cm.Save(servers)
+// SyncManagedProxies makes the proxies whose Source starts with prefix match
+// desired (keyed by server ID). Proxies are matched by source and type so
+// their IDs survive updates; user-created proxies and those of sources in
+// keep are never modified.
+func (st *State) SyncManagedProxies(prefix string, desired map[string][]ProxyConfig, keep map[string]bool) (added, updated, removed []string) {
+	now := time.Now().Format(time.RFC3339)
+	for i := range st.Servers {
+		s := &st.Servers[i]
+		before := len(added) + len(updated) + len(removed)
+		want := make(map[string]ProxyConfig)
+		for _, p := range desired[s.ID] {
+			want[p.Source+"/"+p.Type] = p
+		}
+
+		kept := s.Proxies[:0]
+		for _, p := range s.Proxies {
+			if !strings.HasPrefix(p.Source, prefix) || keep[p.Source] {
+				kept = append(kept, p)
+				continue
+			}
+			key := p.Source + "/" + p.Type
+			next, ok := want[key]
+			if !ok {
+				removed = append(removed, s.Name+"/"+p.Name)
+				continue
+			}
+			delete(want, key)
+			next.ID = p.ID
+			if !proxyEqual(p, next) {
+				updated = append(updated, s.Name+"/"+next.Name)
+			}
+			kept = append(kept, next)
+		}
+		s.Proxies = kept
+
+		for _, p := range desired[s.ID] {
+			if _, ok := want[p.Source+"/"+p.Type]; !ok {
+				continue
+			}
+			clash := false
+			for _, existing := range s.Proxies {
+				if existing.Name == p.Name {
+					clash = true
+				}
+			}
+			if clash {
+				log.Printf("Skipping %s proxy %s on server %s: name already in use", p.Source, p.Name, s.Name)
+				continue
+			}
+			p.ID = generateID()
+			s.Proxies = append(s.Proxies, p)
+			added = append(added, s.Name+"/"+p.Name)
+		}
+
+		if len(added)+len(updated)+len(removed) != before {
+			s.UpdatedAt = now
 		}
 	}
-	return fmt.Errorf("server not found: %s", serverID)
+	return added, updated, removed
 }
 
-func (cm *ConfigManager) UpdateProxy(serverID, proxyID string, proxy ProxyConfig) error {
-	servers, err := cm.Load()
+func proxyEqual(a, b ProxyConfig) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// RenderServer returns a copy of server with {{ .Vars.NAME }} placeholders
+// substituted, plus {{ .Envs.NAME }} when expandEnvs is set, and the
+// placeholders that could not be resolved
+func (cm *ConfigManager) RenderServer(server *ServerConfig, expandEnvs bool) (*ServerConfig, []string, error) {
+	vars, err := cm.vars.Values()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	r, missing := renderServer(server, vars, expandEnvs)
+	return r, missing, nil
+}
 
-	for i := range servers {
-		if servers[i].ID == serverID {
-			for j := range servers[i].Proxies {
-				if servers[i].Proxies[j].ID == proxyID {
-					proxy.ID = proxyID
-					servers[i].Proxies[j] = proxy
-					servers[i].UpdatedAt = time.Now().Format(time.RFC3339)
-					return cm.Save(servers)
-				}
+// RenderMasked is RenderServer for showing config to users: the auth token
+// and the values of secret variables are hidden
+func (cm *ConfigManager) RenderMasked(server *ServerConfig, expandEnvs bool) (*ServerConfig, []string, error) {
+	vars, err := cm.vars.MaskedValues()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, missing := renderServer(server, vars, expandEnvs)
+	if r.AuthToken != "" {
+		r.AuthToken = "******"
+	}
+	return r, missing, nil
+}
+
+// SecretValues returns the secret values generated config may contain, see
+// VariableStore.SecretValues
+func (cm *ConfigManager) SecretValues() []string {
+	values, err := cm.vars.SecretValues()
+	if err != nil {
+		log.Printf("Failed to load variables: %v", err)
+	}
+	return values
+}
+
+func renderServer(server *ServerConfig, vars map[string]string, expandEnvs bool) (*ServerConfig, []string) {
+	missing := make(map[string]bool)
+	render := func(s string) string {
+		return renderPlaceholders(s, vars, expandEnvs, missing)
+	}
+
+	r := *server
+	r.ServerAddr = render(r.ServerAddr)
+	r.AuthToken = render(r.AuthToken)
+	r.User = render(r.User)
+	r.Proxies = make([]ProxyConfig, len(server.Proxies))
+	for i, p := range server.Proxies {
+		p.Name = render(p.Name)
+		p.LocalIP = render(p.LocalIP)
+		p.Subdomain = render(p.Subdomain)
+		if p.CustomDomains != nil {
+			domains := make([]string, len(p.CustomDomains))
+			for j, d := range p.CustomDomains {
+				domains[j] = render(d)
 			}
-			return fmt.Errorf("proxy not found: %s", proxyID)
+			p.CustomDomains = domains
 		}
+		r.Proxies[i] = p
 	}
-	return fmt.Errorf("server not found: %s", serverID)
+
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &r, names
+}
+
+// MissingPlaceholders lists the placeholders GenerateToml cannot resolve
+// for server; frpc would fail on them at startup
+func (cm *ConfigManager) MissingPlaceholders(server *ServerConfig) ([]string, error) {
+	_, missing, err := cm.RenderServer(server, cm.expandEnvs)
+	return missing, err
 }
 
-func (cm *ConfigManager) DeleteProxy(serverID, proxyID string) error {
-	servers, err := cm.Load()
+// CheckRunnable reports why server cannot be run: placeholders that cannot
+// be resolved, or values they resolve to that would break the generated
+// TOML
+func (cm *ConfigManager) CheckRunnable(server *ServerConfig) error {
+	missing, err := cm.MissingPlaceholders(server)
 	if err != nil {
 		return err
 	}
+	if len(missing) > 0 {
+		return fmt.Errorf("unresolved placeholders: %s", strings.Join(missing, ", "))
+	}
+	// Environment placeholders passed through to frpc resolve to the same
+	// values there
+	rendered, _, err := cm.RenderServer(server, true)
+	if err != nil {
+		return err
+	}
+	return validateRendered(rendered)
+}
 
-	for i := range servers {
-		if servers[i].ID == serverID {
-			for j := range servers[i].Proxies {
-				if servers[i].Proxies[j].ID == proxyID {
-					servers[i].Proxies[j] = servers[i].Proxies[len(servers[i].Proxies)-1]
-					servers[i].Proxies = servers[i].Proxies[:len(servers[i].Proxies)-1]
-					servers[i].UpdatedAt = time.Now().Format(time.RFC3339)
-					return cm.Save(servers)
-				}
-			}
-			return fmt.Errorf("proxy not found: %s", proxyID)
-		}
+// GenerateToml generates frpc.toml content for a server. GUI variables are
+// substituted; environment placeholders are passed through to frpc, which
+// renders them natively, unless expandEnvs is set.
+// RunnableToml returns the current config of a server for starting it, or
+// an error if it cannot be started as it is
+func (cm *ConfigManager) RunnableToml(serverID string) (string, error) {
+	server, err := cm.GetServer(serverID)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Errorf("server not found: %s", serverID)
+	if err := cm.CheckRunnable(server); err != nil {
+		return "", err
+	}
+	return cm.GenerateToml(server), nil
 }
 
-// GenerateToml generates frpc.toml content for a server
 func (cm *ConfigManager) GenerateToml(server *ServerConfig) string {
+	rendered, _, err := cm.RenderServer(server, cm.expandEnvs)
+	if err != nil {
+		log.Printf("Failed to render placeholders for server %s: %v", server.Name, err)
+		rendered = server
+	}
+	return formatToml(rendered)
+}
+
+func formatToml(server *ServerConfig) string {
 	var b strings.Builder
 
 	b.WriteString("# Auto-generated by fnos-frpc-gui\n\n")
@@ -233,6 +677,10 @@ func (cm *ConfigManager) GenerateToml(server *ServerConfig) string {
 		b.WriteString(fmt.Sprintf("token = \"%s\"\n", server.AuthToken))
 	}
 
+	if server.Protocol != "" && server.Protocol != "tcp" {
+		b.WriteString(fmt.Sprintf("\n[transport]\nprotocol = \"%s\"\n", server.Protocol))
+	}
+
 	if server.TLSEnable {
 		b.WriteString("\n[transport.tls]\nenable = true\n")
 	}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestConfigManager returns a ConfigManager backed by a temporary data
+// directory
+func newTestConfigManager(t *testing.T) (*ConfigManager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	secrets, err := NewSecretStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewJSONStorage(filepath.Join(dir, "servers.json"))
+	history := NewHistoryManager(dir, 10)
+	// Snapshots are written in the background; finish before dir is removed
+	t.Cleanup(history.Flush)
+	return NewConfigManager(store, secrets, NewVariableStore(dir, secrets), history), dir
+}
+
+func addTestServer(t *testing.T, cm *ConfigManager, name string) string {
+	t.Helper()
+	var id string
+	err := cm.Update(func(st *State) error {
+		id = st.AddServer(ServerConfig{Name: name, ServerAddr: "frps.example.com", ServerPort: 7000}).ID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestConcurrentProxyCreates(t *testing.T) {
+	cm, dir := newTestConfigManager(t)
+	serverID := addTestServer(t, cm, "home")
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- cm.UpdateAs("test", "", func(st *State) error {
+				_, err := st.AddProxy(serverID, ProxyConfig{
+					Name:      fmt.Sprintf("proxy-%d", i),
+					Type:      "tcp",
+					LocalIP:   "127.0.0.1",
+					LocalPort: 8000 + i,
+				})
+				return err
+			})
+		}(i)
+		// Readers run alongside the writers
+		go func() {
+			defer wg.Done()
+			_, err := cm.Load()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, err := cm.GetServer(serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Proxies) != n {
+		t.Fatalf("got %d proxies in memory, want %d", len(server.Proxies), n)
+	}
+	names := make(map[string]bool)
+	for _, p := range server.Proxies {
+		names[p.Name] = true
+	}
+	if len(names) != n {
+		t.Fatalf("got %d distinct proxy names, want %d", len(names), n)
+	}
+
+	// Every create must also have reached the file
+	secrets, _ := NewSecretStore(dir)
+	fresh := NewConfigManager(NewJSONStorage(filepath.Join(dir, "servers.json")), secrets, NewVariableStore(dir, secrets), NewHistoryManager(dir, 10))
+	server, err = fresh.GetServer(serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Proxies) != n {
+		t.Fatalf("got %d proxies on disk, want %d", len(server.Proxies), n)
+	}
+}
+
+func TestSecretVariablesMasked(t *testing.T) {
+	cm, _ := newTestConfigManager(t)
+	if err := cm.vars.Set(Variable{Name: "HOST", Value: "frps.secret.example.com", Secret: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.vars.Set(Variable{Name: "LAN", Value: "nas", Secret: false}); err != nil {
+		t.Fatal(err)
+	}
+	server := &ServerConfig{
+		ID: "s", Name: "home", ServerAddr: "{{ .Vars.HOST }}", ServerPort: 7000, User: "u-{{ .Vars.HOST }}", AuthToken: "token",
+		Proxies: []ProxyConfig{{
+			Name: "web", Type: "http", LocalIP: "{{ .Vars.LAN }}", LocalPort: 80,
+			CustomDomains: []string{"{{ .Vars.HOST }}"},
+		}},
+	}
+
+	rendered, _, err := cm.RenderMasked(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview := formatToml(rendered)
+	generated := cm.GenerateToml(server)
+
+	// Rotating the secret leaves the old value in configs generated before
+	if err := cm.vars.Set(Variable{Name: "HOST", Value: "frps2.secret.example.com", Secret: true}); err != nil {
+		t.Fatal(err)
+	}
+	masked := maskToml(generated, cm.SecretValues())
+
+	for name, toml := range map[string]string{"preview": preview, "masked": masked} {
+		if strings.Contains(toml, "secret.example.com") || strings.Contains(toml, `token = "token"`) {
+			t.Fatalf("%s leaks a secret:\n%s", name, toml)
+		}
+		if !strings.Contains(toml, `localIP = "nas"`) {
+			t.Fatalf("%s hides a plain variable:\n%s", name, toml)
+		}
+	}
+}
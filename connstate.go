@@ -0,0 +1,150 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Connection states tell whether frpc is actually logged in to frps, which
+// a running process alone does not
+const (
+	connStarting     = "starting"     // frpc launched, nothing logged yet
+	connConnecting   = "connecting"   // trying to log in for the first time
+	connConnected    = "connected"    // logged in to frps
+	connAuthFailed   = "auth_failed"  // frps rejected the login
+	connReconnecting = "reconnecting" // lost the connection after logging in
+	connStopped      = "stopped"
+	connCrashed      = "crashed" // exited with an error
+)
+
+// connHistorySize is how many transitions are kept per server
+const connHistorySize = 20
+
+// frps rejects a login with e.g. "authorization failed" or a token error
+var authFailedRe = regexp.MustCompile(`(?i)authori[sz]ation|authenticat|token|invalid user|privilege`)
+
+// ConnTransition is one change of a server's connection state
+type ConnTransition struct {
+	State  string `json:"state"`
+	Time   string `json:"time"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConnectionStatus is the current connection state of a server and how it
+// got there
+type ConnectionStatus struct {
+	State   string           `json:"state"`
+	Since   string           `json:"since,omitempty"`
+	Reason  string           `json:"reason,omitempty"`
+	History []ConnTransition `json:"history"` // oldest first
+}
+
+// ConnTracker derives connection states from frpc events and process
+// lifecycle changes
+type ConnTracker struct {
+	history map[string][]ConnTransition
+	mu      sync.Mutex
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{history: make(map[string][]ConnTransition)}
+}
+
+// state returns the current state of a server. ct.mu must be held.
+func (ct *ConnTracker) state(serverID string) string {
+	h := ct.history[serverID]
+	if len(h) == 0 {
+		return connStopped
+	}
+	return h[len(h)-1].State
+}
+
+// transition records a change of state; staying in the same state is not
+// recorded. ct.mu must be held.
+func (ct *ConnTracker) transition(serverID, state, reason string) {
+	if ct.state(serverID) == state && len(ct.history[serverID]) > 0 {
+		return
+	}
+	h := append(ct.history[serverID], ConnTransition{State: state, Time: time.Now().Format(time.RFC3339), Reason: reason})
+	if len(h) > connHistorySize {
+		h = append([]ConnTransition(nil), h[len(h)-connHistorySize:]...)
+	}
+	ct.history[serverID] = h
+}
+
+// Set records a lifecycle change such as a start, stop or exit
+func (ct *ConnTracker) Set(serverID, state, reason string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.transition(serverID, state, reason)
+}
+
+// Exited records that frpc exited on its own. A rejected login makes frpc
+// exit by default, so auth_failed is kept as the more useful state.
+func (ct *ConnTracker) Exited(serverID string, err error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	switch {
+	case ct.state(serverID) == connAuthFailed:
+	case err != nil:
+		ct.transition(serverID, connCrashed, err.Error())
+	default:
+		ct.transition(serverID, connStopped, "exit status 0")
+	}
+}
+
+// Observe moves a server's state on according to a live frpc event.
+// Events of proxies, such as failing to reach a local service, do not
+// affect the connection to frps.
+func (ct *ConnTracker) Observe(serverID string, ev LogEvent) {
+	if ev.Proxy != "" {
+		return
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	current := ct.state(serverID)
+	if current == connStopped || current == connCrashed {
+		return // output after the exit was recorded
+	}
+	// Without a session a lost connection means we are still connecting
+	retrying := connConnecting
+	if current == connConnected || current == connReconnecting {
+		retrying = connReconnecting
+	}
+
+	switch ev.Category {
+	case eventLogin:
+		ct.transition(serverID, connConnected, "")
+	case eventLoginFailed:
+		if authFailedRe.MatchString(ev.Message) {
+			ct.transition(serverID, connAuthFailed, ev.Message)
+		} else if current != connAuthFailed {
+			ct.transition(serverID, retrying, ev.Message)
+		}
+	case eventServiceStarted, eventConnectFailed, eventReconnecting, eventDisconnected:
+		// Retrying with a rejected token keeps failing the same way
+		if current != connAuthFailed {
+			ct.transition(serverID, retrying, ev.Message)
+		}
+	}
+}
+
+// Status returns the connection state of a server
+func (ct *ConnTracker) Status(serverID string) ConnectionStatus {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	h := ct.history[serverID]
+	if len(h) == 0 {
+		return ConnectionStatus{State: connStopped, History: []ConnTransition{}}
+	}
+	last := h[len(h)-1]
+	return ConnectionStatus{
+		State:   last.State,
+		Since:   last.Time,
+		Reason:  last.Reason,
+		History: append([]ConnTransition(nil), h...),
+	}
+}
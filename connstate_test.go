@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConnTrackerObserve(t *testing.T) {
+	ev := func(category, message string) LogEvent {
+		return LogEvent{Category: category, Message: message}
+	}
+	tests := []struct {
+		name   string
+		start  string // state set before the events
+		events []LogEvent
+		exit   error // exit recorded after the events, if any
+		want   string
+	}{
+		{"login", connStarting, []LogEvent{ev(eventLogin, "login to server success")}, nil, connConnected},
+		{"service started", connStarting, []LogEvent{ev(eventServiceStarted, "start frpc service")}, nil, connConnecting},
+		{"first connect fails", connStarting, []LogEvent{ev(eventConnectFailed, "connection refused")}, nil, connConnecting},
+		{"connection lost", connStarting, []LogEvent{ev(eventLogin, ""), ev(eventDisconnected, "heartbeat timeout")}, nil, connReconnecting},
+		{"still reconnecting", connStarting, []LogEvent{ev(eventLogin, ""), ev(eventDisconnected, ""), ev(eventConnectFailed, "")}, nil, connReconnecting},
+		{"back again", connStarting, []LogEvent{ev(eventLogin, ""), ev(eventReconnecting, ""), ev(eventLogin, "")}, nil, connConnected},
+		{"token rejected", connStarting, []LogEvent{ev(eventLoginFailed, "authorization failed")}, nil, connAuthFailed},
+		{"login fails otherwise", connStarting, []LogEvent{ev(eventLoginFailed, "i/o timeout")}, nil, connConnecting},
+		{"retries keep auth_failed", connStarting, []LogEvent{ev(eventLoginFailed, "token mismatch"), ev(eventReconnecting, ""), ev(eventLoginFailed, "EOF")}, nil, connAuthFailed},
+		{"auth_failed survives exit", connStarting, []LogEvent{ev(eventLoginFailed, "invalid user")}, errors.New("exit status 1"), connAuthFailed},
+		{"crash", connStarting, []LogEvent{ev(eventLogin, "")}, errors.New("exit status 2"), connCrashed},
+		{"proxy events ignored", connStarting, []LogEvent{ev(eventLogin, ""), {Category: eventConnectFailed, Proxy: "web", Message: "connect to local service"}}, nil, connConnected},
+		{"output after stop ignored", connStopped, []LogEvent{ev(eventLogin, "")}, nil, connStopped},
+		{"output after crash ignored", connCrashed, []LogEvent{ev(eventLogin, "")}, nil, connCrashed},
+	}
+	for _, tt := range tests {
+		ct := NewConnTracker()
+		ct.Set("s", tt.start, "")
+		for _, e := range tt.events {
+			ct.Observe("s", e)
+		}
+		if tt.exit != nil {
+			ct.Exited("s", tt.exit)
+		}
+		if got := ct.Status("s").State; got != tt.want {
+			t.Errorf("%s: state %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConnTrackerHistory(t *testing.T) {
+	ct := NewConnTracker()
+	if st := ct.Status("s"); st.State != connStopped || len(st.History) != 0 {
+		t.Fatalf("unknown server: %+v", st)
+	}
+	ct.Set("s", connStarting, "")
+	ct.Observe("s", LogEvent{Category: eventLogin})
+	ct.Observe("s", LogEvent{Category: eventLogin}) // not a transition
+	if h := ct.Status("s").History; len(h) != 2 || h[0].State != connStarting || h[1].State != connConnected {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	for i := 0; i < connHistorySize; i++ {
+		ct.Observe("s", LogEvent{Category: eventDisconnected})
+		ct.Observe("s", LogEvent{Category: eventLogin})
+	}
+	h := ct.Status("s").History
+	if len(h) != connHistorySize || h[len(h)-1].State != connConnected {
+		t.Fatalf("history not capped: %d entries", len(h))
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const diagnoseTimeout = 5 * time.Second
+
+// DiagnoseStep is one stage of a server connectivity check
+type DiagnoseStep struct {
+	Name       string      `json:"name"`
+	Status     string      `json:"status"` // ok, warn, fail, skip
+	DurationMs float64     `json:"durationMs"`
+	Detail     string      `json:"detail,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// DiagnoseReport is the step-by-step result of DiagnoseServer
+type DiagnoseReport struct {
+	ServerAddr string          `json:"serverAddr"`
+	ServerPort int             `json:"serverPort"`
+	Protocol   string          `json:"protocol"`
+	OK         bool            `json:"ok"`
+	FailedStep string          `json:"failedStep,omitempty"`
+	Steps      []*DiagnoseStep `json:"steps"`
+}
+
+func (r *DiagnoseReport) add(step *DiagnoseStep) *DiagnoseStep {
+	r.Steps = append(r.Steps, step)
+	if step.Status == "fail" && r.FailedStep == "" {
+		r.FailedStep = step.Name
+	}
+	return step
+}
+
+// DiagnoseServer checks DNS, TCP reachability, TLS and the configured
+// transport protocol of a frps server, stopping at the first hard failure
+func DiagnoseServer(server *ServerConfig) *DiagnoseReport {
+	protocol := server.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	report := &DiagnoseReport{
+		ServerAddr: server.ServerAddr,
+		ServerPort: server.ServerPort,
+		Protocol:   protocol,
+	}
+
+	addrs := report.add(diagnoseDNS(server.ServerAddr))
+	if addrs.Status == "fail" {
+		return report
+	}
+	ips := addrs.Data.([]string)
+
+	switch protocol {
+	case "kcp", "quic":
+		// UDP-based transports never touch the TCP port
+		report.add(&DiagnoseStep{Name: "tcp", Status: "skip", Detail: protocol + " runs over UDP"})
+		report.add(&DiagnoseStep{Name: "tls", Status: "skip", Detail: "TLS is not used with " + protocol})
+		report.add(diagnoseUDP(protocol, ips, server.ServerPort))
+	default:
+		tcp := report.add(diagnoseTCP(ips, server.ServerPort))
+		if tcp.Status == "fail" {
+			break
+		}
+		addr := tcp.Data.(map[string]interface{})["connected"].(string)
+
+		useTLS := server.TLSEnable || protocol == "wss"
+		if useTLS {
+			report.add(diagnoseTLS(addr, server.ServerAddr))
+		} else {
+			report.add(&DiagnoseStep{Name: "tls", Status: "skip", Detail: "TLS is not enabled"})
+		}
+
+		switch protocol {
+		case "websocket", "wss":
+			report.add(diagnoseWebsocket(addr, server.ServerAddr, protocol == "wss"))
+		default:
+			report.add(&DiagnoseStep{Name: "transport", Status: "ok", Detail: "tcp transport uses the connection checked above"})
+		}
+	}
+
+	report.OK = report.FailedStep == ""
+	return report
+}
+
+func diagnoseDNS(host string) *DiagnoseStep {
+	step := &DiagnoseStep{Name: "dns"}
+	if ip := net.ParseIP(host); ip != nil {
+		step.Status = "skip"
+		step.Detail = "server address is an IP literal"
+		step.Data = []string{ip.String()}
+		return step
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	step.DurationMs = msSince(start)
+	if err != nil {
+		step.Status = "fail"
+		step.Error = err.Error()
+		return step
+	}
+
+	var ips []string
+	var v4, v6 int
+	for _, a := range addrs {
+		ips = append(ips, a.IP.String())
+		if a.IP.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	step.Status = "ok"
+	step.Detail = fmt.Sprintf("%d A, %d AAAA record(s)", v4, v6)
+	step.Data = ips
+	return step
+}
+
+func diagnoseTCP(ips []string, port int) *DiagnoseStep {
+	step := &DiagnoseStep{Name: "tcp"}
+	attempts := make([]map[string]interface{}, 0, len(ips))
+
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, diagnoseTimeout)
+		elapsed := msSince(start)
+		if err != nil {
+			attempts = append(attempts, map[string]interface{}{
+				"address": addr, "latencyMs": elapsed, "error": describeDialError(err),
+			})
+			continue
+		}
+		conn.Close()
+		attempts = append(attempts, map[string]interface{}{"address": addr, "latencyMs": elapsed})
+
+		step.Status = "ok"
+		step.DurationMs = elapsed
+		step.Detail = fmt.Sprintf("connected to %s in %.1f ms", addr, elapsed)
+		step.Data = map[string]interface{}{"connected": addr, "attempts": attempts}
+		return step
+	}
+
+	step.Status = "fail"
+	step.Error = "no address accepted a TCP connection"
+	if len(attempts) > 0 {
+		step.Error = attempts[len(attempts)-1]["error"].(string)
+	}
+	step.Data = map[string]interface{}{"attempts": attempts}
+	return step
+}
+
+func diagnoseTLS(addr, serverName string) *DiagnoseStep {
+	step := &DiagnoseStep{Name: "tls"}
+
+	dialer := &net.Dialer{Timeout: diagnoseTimeout}
+	start := time.Now()
+	// frps usually presents a self-signed certificate, so the chain is
+	// reported rather than enforced.
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	step.DurationMs = msSince(start)
+	if err != nil {
+		step.Status = "fail"
+		step.Error = "TLS handshake failed: " + err.Error()
+		return step
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+
+	info := describeTLS(&state, serverName)
+	step.Data = info
+	step.Status = "ok"
+	step.Detail = fmt.Sprintf("%s, %s", info.Version, info.CipherSuite)
+	if !info.Verified {
+		step.Status = "warn"
+		step.Detail += "; certificate not trusted: " + info.VerifyError
+	}
+	return step
+}
+
+func diagnoseWebsocket(addr, host string, secure bool) *DiagnoseStep {
+	step := &DiagnoseStep{Name: "transport"}
+
+	dialer := &net.Dialer{Timeout: diagnoseTimeout}
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		step.Status = "fail"
+		step.Error = describeDialError(err)
+		return step
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(diagnoseTimeout))
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	// frps serves its websocket transport on this fixed path
+	req := fmt.Sprintf("GET /~!frp HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", host, base64.StdEncoding.EncodeToString(key))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		step.Status = "fail"
+		step.Error = err.Error()
+		return step
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	step.DurationMs = msSince(start)
+	if err != nil {
+		step.Status = "fail"
+		step.Error = "no HTTP response to websocket upgrade: " + err.Error()
+		return step
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		step.Status = "fail"
+		step.Error = fmt.Sprintf("websocket upgrade rejected with HTTP %d", resp.StatusCode)
+		return step
+	}
+	step.Status = "ok"
+	step.Detail = "websocket upgrade accepted"
+	return step
+}
+
+func diagnoseUDP(protocol string, ips []string, port int) *DiagnoseStep {
+	step := &DiagnoseStep{Name: "transport"}
+	addr := net.JoinHostPort(ips[0], strconv.Itoa(port))
+
+	conn, err := net.DialTimeout("udp", addr, diagnoseTimeout)
+	if err != nil {
+		step.Status = "fail"
+		step.Error = describeDialError(err)
+		return step
+	}
+	defer conn.Close()
+
+	payload := []byte{0}
+	if protocol == "quic" {
+		payload = quicVersionProbe()
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(payload); err != nil {
+		step.Status = "fail"
+		step.Error = err.Error()
+		return step
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	step.DurationMs = msSince(start)
+
+	switch {
+	case err == nil:
+		if protocol == "quic" && isQUICVersionNegotiation(buf[:n]) {
+			step.Status = "ok"
+			step.Detail = "QUIC server answered with version negotiation"
+			return step
+		}
+		step.Status = "ok"
+		step.Detail = fmt.Sprintf("received %d byte reply on %s", n, addr)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		step.Status = "fail"
+		step.Error = "UDP port unreachable; frps is not listening for " + protocol
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		step.Status = "warn"
+		step.Detail = "no reply within 2s; UDP may be filtered or the server ignores probes"
+	default:
+		step.Status = "fail"
+		step.Error = err.Error()
+	}
+	return step
+}
+
+// quicVersionProbe builds a padded long-header packet with a reserved
+// version, which a QUIC server must answer with version negotiation
+func quicVersionProbe() []byte {
+	pkt := make([]byte, 1200)
+	pkt[0] = 0xc0
+	copy(pkt[1:5], []byte{0x1a, 0x2a, 0x3a, 0x4a})
+	pkt[5] = 8
+	rand.Read(pkt[6:14])
+	pkt[14] = 8
+	rand.Read(pkt[15:23])
+	return pkt
+}
+
+func isQUICVersionNegotiation(b []byte) bool {
+	return len(b) >= 5 && b[0]&0x80 != 0 && b[1] == 0 && b[2] == 0 && b[3] == 0 && b[4] == 0
+}
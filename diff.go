@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is one difference between two configuration states
+type Change struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // added, removed, changed
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// keyedServers turns servers into nested maps keyed by server and proxy ID,
+// so a diff follows objects instead of list positions
+func keyedServers(servers []ServerConfig) map[string]interface{} {
+	out := make(map[string]interface{}, len(servers))
+	for _, s := range servers {
+		var m map[string]interface{}
+		b, _ := json.Marshal(s)
+		json.Unmarshal(b, &m)
+
+		proxies := make(map[string]interface{}, len(s.Proxies))
+		for _, p := range s.Proxies {
+			var pm map[string]interface{}
+			b, _ := json.Marshal(p)
+			json.Unmarshal(b, &pm)
+			proxies[p.ID] = pm
+		}
+		m["proxies"] = proxies
+		out[s.ID] = m
+	}
+	return out
+}
+
+// diffServers lists field-level changes between two states. Auth tokens are
+// compared in plain text but reported only as set/unset.
+func diffServers(from, to []ServerConfig) []Change {
+	changes := []Change{}
+	diffValues("servers", keyedServers(from), keyedServers(to), &changes)
+	kept := changes[:0]
+	for _, c := range changes {
+		// Revisions follow from the other changes
+		if !strings.HasSuffix(c.Path, "/revision") {
+			kept = append(kept, c)
+		}
+	}
+	changes = kept
+	for i := range changes {
+		if strings.HasSuffix(changes[i].Path, "/authToken") {
+			changes[i].From = maskSecret(changes[i].From)
+			changes[i].To = maskSecret(changes[i].To)
+		}
+		if changes[i].Op == "added" || changes[i].Op == "removed" {
+			redactTokens(changes[i].From)
+			redactTokens(changes[i].To)
+		}
+	}
+	return changes
+}
+
+func maskSecret(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	s, _ := v.(string)
+	return secretStatus(s)
+}
+
+func redactTokens(v interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := m["authToken"]; ok {
+		m["authToken"] = maskSecret(m["authToken"])
+	}
+}
+
+func diffValues(path string, a, b interface{}, changes *[]Change) {
+	am, aIsMap := a.(map[string]interface{})
+	bm, bIsMap := b.(map[string]interface{})
+	if !aIsMap || !bIsMap {
+		if !reflect.DeepEqual(a, b) {
+			*changes = append(*changes, Change{Path: path, Op: "changed", From: a, To: b})
+		}
+		return
+	}
+
+	keys := make(map[string]bool)
+	for k := range am {
+		keys[k] = true
+	}
+	for k := range bm {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		av, inA := am[k]
+		bv, inB := bm[k]
+		p := path + "/" + k
+		switch {
+		case !inA:
+			*changes = append(*changes, Change{Path: p, Op: "added", To: bv})
+		case !inB:
+			*changes = append(*changes, Change{Path: p, Op: "removed", From: av})
+		default:
+			diffValues(p, av, bv, changes)
+		}
+	}
+}
+
+// summarizeChanges describes the difference between two states in short
+// human-readable lines, e.g. "server vps: added proxy ssh"
+func summarizeChanges(from, to []ServerConfig) []string {
+	var lines []string
+	old := make(map[string]ServerConfig, len(from))
+	for _, s := range from {
+		old[s.ID] = s
+	}
+	seen := make(map[string]bool, len(to))
+
+	for _, s := range to {
+		seen[s.ID] = true
+		prev, ok := old[s.ID]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("added server %s", s.Name))
+			continue
+		}
+		if fields := changedFields(prev, s, "proxies", "updatedAt", "revision"); len(fields) > 0 {
+			lines = append(lines, fmt.Sprintf("server %s: changed %s", s.Name, strings.Join(fields, ", ")))
+		}
+
+		oldProxies := make(map[string]ProxyConfig, len(prev.Proxies))
+		for _, p := range prev.Proxies {
+			oldProxies[p.ID] = p
+		}
+		for _, p := range s.Proxies {
+			op, ok := oldProxies[p.ID]
+			if !ok {
+				lines = append(lines, fmt.Sprintf("server %s: added proxy %s", s.Name, p.Name))
+				continue
+			}
+			delete(oldProxies, p.ID)
+			if fields := changedFields(op, p, "revision"); len(fields) > 0 {
+				lines = append(lines, fmt.Sprintf("server %s: proxy %s changed %s", s.Name, p.Name, strings.Join(fields, ", ")))
+			}
+		}
+		for _, p := range prev.Proxies {
+			if _, gone := oldProxies[p.ID]; gone {
+				lines = append(lines, fmt.Sprintf("server %s: removed proxy %s", s.Name, p.Name))
+			}
+		}
+	}
+
+	for _, s := range from {
+		if !seen[s.ID] {
+			lines = append(lines, fmt.Sprintf("removed server %s", s.Name))
+		}
+	}
+	return lines
+}
+
+// changedFields lists the JSON fields that differ between a and b
+func changedFields(a, b interface{}, ignore ...string) []string {
+	var am, bm map[string]interface{}
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	json.Unmarshal(ab, &am)
+	json.Unmarshal(bb, &bm)
+
+	skip := make(map[string]bool, len(ignore))
+	for _, k := range ignore {
+		skip[k] = true
+	}
+
+	var fields []string
+	for k := range mergeKeys(am, bm) {
+		if !skip[k] && !reflect.DeepEqual(am[k], bm[k]) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func mergeKeys(a, b map[string]interface{}) map[string]bool {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// maxDiffCells bounds the LCS table; larger changes are shown as a block
+// replacement instead
+const maxDiffCells = 4 << 20
+
+// unifiedDiff returns a unified diff of two texts with three lines of
+// context, or "" when they are equal
+func unifiedDiff(a, b, nameA, nameB string) string {
+	if a == b {
+		return ""
+	}
+	al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	if a == "" {
+		al = nil
+	}
+	if b == "" {
+		bl = nil
+	}
+	ops := diffLines(al, bl)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+
+	const context = 3
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*context {
+				break
+			}
+		}
+		stop := end + context + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aStart, bStart, aLen, bLen := 0, 0, 0, 0
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart+1, aLen, bStart+1, bLen)
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			out.WriteByte('\n')
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+type diffOp struct {
+	kind byte // ' ', '-', '+'
+	text string
+}
+
+func diffLines(a, b []string) []diffOp {
+	// Common prefix and suffix cover most config edits cheaply
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, diffMiddle(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+func diffMiddle(a, b []string) []diffOp {
+	var ops []diffOp
+	if len(a)*len(b) > maxDiffCells {
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
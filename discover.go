@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListeningService is a local socket that could be exposed through a proxy
+type ListeningService struct {
+	Protocol      string         `json:"protocol"` // tcp, udp
+	Address       string         `json:"address"`
+	Port          int            `json:"port"`
+	PID           int            `json:"pid,omitempty"`
+	Process       string         `json:"process,omitempty"`
+	Exposed       bool           `json:"exposed"`
+	ExposedBy     []ExposedProxy `json:"exposedBy,omitempty"`
+	SuggestedType string         `json:"suggestedType"`
+}
+
+// ExposedProxy identifies a proxy that already forwards a local port
+type ExposedProxy struct {
+	ServerID   string `json:"serverId"`
+	ServerName string `json:"serverName"`
+	ProxyID    string `json:"proxyId"`
+	ProxyName  string `json:"proxyName"`
+}
+
+type procSocket struct {
+	protocol string
+	ip       net.IP
+	port     int
+	inode    string
+}
+
+// DiscoverServices lists listening TCP and bound UDP sockets from /proc/net,
+// marks those already used by a proxy and suggests a proxy type for the rest
+func DiscoverServices(servers []ServerConfig, probe bool) ([]*ListeningService, error) {
+	var sockets []procSocket
+	sources := []struct{ file, protocol string }{
+		{"/proc/net/tcp", "tcp"},
+		{"/proc/net/tcp6", "tcp"},
+		{"/proc/net/udp", "udp"},
+		{"/proc/net/udp6", "udp"},
+	}
+	found := false
+	for _, src := range sources {
+		list, err := readProcNet(src.file, src.protocol)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read %s: %v", src.file, err)
+		}
+		found = true
+		sockets = append(sockets, list...)
+	}
+	if !found {
+		return nil, fmt.Errorf("service discovery requires Linux /proc/net")
+	}
+
+	owners := socketOwners()
+
+	// The same port is often bound on both IPv4 and IPv6; report it once,
+	// preferring the wildcard address.
+	byKey := make(map[string]*ListeningService)
+	for _, s := range sockets {
+		key := fmt.Sprintf("%s/%d", s.protocol, s.port)
+		svc, ok := byKey[key]
+		if !ok {
+			svc = &ListeningService{Protocol: s.protocol, Address: s.ip.String(), Port: s.port}
+			byKey[key] = svc
+		} else if s.ip.IsUnspecified() && !net.ParseIP(svc.Address).IsUnspecified() {
+			svc.Address = s.ip.String()
+		}
+		if owner, ok := owners[s.inode]; ok && svc.PID == 0 {
+			svc.PID = owner.pid
+			svc.Process = owner.name
+		}
+	}
+
+	services := make([]*ListeningService, 0, len(byKey))
+	for _, svc := range byKey {
+		for _, server := range servers {
+			for _, p := range server.Proxies {
+				if p.LocalPort != svc.Port || proxyTransport(p.Type) != svc.Protocol {
+					continue
+				}
+				svc.Exposed = true
+				svc.ExposedBy = append(svc.ExposedBy, ExposedProxy{
+					ServerID: server.ID, ServerName: server.Name, ProxyID: p.ID, ProxyName: p.Name,
+				})
+			}
+		}
+		svc.SuggestedType = svc.Protocol
+		services = append(services, svc)
+	}
+
+	if probe {
+		suggestTypes(services)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Protocol != services[j].Protocol {
+			return services[i].Protocol < services[j].Protocol
+		}
+		return services[i].Port < services[j].Port
+	})
+	return services, nil
+}
+
+// proxyTransport maps a proxy type to the socket protocol it forwards
+func proxyTransport(proxyType string) string {
+	if proxyType == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// readProcNet parses a /proc/net/{tcp,udp}[6] table and returns the sockets
+// that accept traffic: LISTEN for tcp, unconnected for udp
+func readProcNet(path, protocol string) ([]procSocket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// st 0A is TCP_LISTEN; st 07 is TCP_CLOSE, which unconnected UDP sockets report
+	wantState := "0A"
+	if protocol == "udp" {
+		wantState = "07"
+	}
+
+	var sockets []procSocket
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != wantState {
+			continue
+		}
+		ip, port, err := parseProcAddr(fields[1])
+		if err != nil || port == 0 {
+			continue
+		}
+		sockets = append(sockets, procSocket{protocol: protocol, ip: ip, port: port, inode: fields[9]})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcAddr decodes "0100007F:1F90"; the address is stored as 32-bit
+// words in host (little-endian) byte order
+func parseProcAddr(s string) (net.IP, int, error) {
+	hostHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	raw, err := hex.DecodeString(hostHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, 0, fmt.Errorf("malformed address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, int(port), nil
+}
+
+type socketOwner struct {
+	pid  int
+	name string
+}
+
+// socketOwners maps socket inodes to the owning process by walking
+// /proc/*/fd; processes we are not permitted to inspect are skipped
+func socketOwners() map[string]socketOwner {
+	owners := make(map[string]socketOwner)
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var name string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if name == "" {
+				comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+				name = strings.TrimSpace(string(comm))
+			}
+			owners[inode] = socketOwner{pid: pid, name: name}
+		}
+	}
+	return owners
+}
+
+// suggestTypes probes unexposed TCP services to tell HTTP and HTTPS
+// servers apart from plain TCP ones
+func suggestTypes(services []*ListeningService) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 16)
+	for _, svc := range services {
+		if svc.Protocol != "tcp" || svc.Exposed {
+			continue
+		}
+		wg.Add(1)
+		go func(svc *ListeningService) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			svc.SuggestedType = sniffTCPService(probeAddress(svc.Address), svc.Port)
+		}(svc)
+	}
+	wg.Wait()
+}
+
+func probeAddress(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return "127.0.0.1"
+	case ip.IsUnspecified() && ip.To4() != nil:
+		return "127.0.0.1"
+	case ip.IsUnspecified():
+		return "::1"
+	}
+	return addr
+}
+
+func sniffTCPService(host string, port int) string {
+	const timeout = 800 * time.Millisecond
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "tcp"
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\n\r\n", host)
+	buf := make([]byte, 5)
+	n, _ := conn.Read(buf)
+	conn.Close()
+	if n == 5 && string(buf) == "HTTP/" {
+		return "http"
+	}
+
+	conn, err = net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "tcp"
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err == nil {
+		return "https"
+	}
+	return "tcp"
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerLabelPrefix  = "frpc.proxy."
+	dockerServerLabel  = "frpc.server"
+	dockerSourcePrefix = "docker:"
+)
+
+// DockerClient is a minimal Docker Engine API client over a Unix socket
+type DockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+type DockerPort struct {
+	IP          string `json:"ip,omitempty"`
+	PrivatePort int    `json:"privatePort"`
+	PublicPort  int    `json:"publicPort,omitempty"`
+	Type        string `json:"type"`
+}
+
+type DockerContainer struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	State       string            `json:"state"`
+	NetworkMode string            `json:"networkMode"`
+	Ports       []DockerPort      `json:"ports"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// DockerSuggestion is a proxy that could be created for a container port
+type DockerSuggestion struct {
+	Container string      `json:"container"`
+	Proxy     ProxyConfig `json:"proxy"`
+	Exposed   bool        `json:"exposed"`
+}
+
+// DockerReconcileReport summarizes one label reconciliation pass
+type DockerReconcileReport struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+	Errors  []string `json:"errors"`
+}
+
+func NewDockerClient(socket string) *DockerClient {
+	return &DockerClient{
+		socket: socket,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (dc *DockerClient) get(path string, out interface{}) error {
+	// The host part is ignored; every request goes to the socket
+	resp, err := dc.http.Get("http://docker" + path)
+	if err != nil {
+		return fmt.Errorf("docker API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("docker API %s returned status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ListContainers returns the running containers with their ports and labels
+func (dc *DockerClient) ListContainers() ([]DockerContainer, error) {
+	var raw []struct {
+		ID    string   `json:"Id"`
+		Names []string `json:"Names"`
+		Image string   `json:"Image"`
+		State string   `json:"State"`
+		Ports []struct {
+			IP          string `json:"IP"`
+			PrivatePort int    `json:"PrivatePort"`
+			PublicPort  int    `json:"PublicPort"`
+			Type        string `json:"Type"`
+		} `json:"Ports"`
+		Labels     map[string]string `json:"Labels"`
+		HostConfig struct {
+			NetworkMode string `json:"NetworkMode"`
+		} `json:"HostConfig"`
+	}
+	if err := dc.get("/containers/json", &raw); err != nil {
+		return nil, err
+	}
+
+	containers := make([]DockerContainer, 0, len(raw))
+	for _, c := range raw {
+		name := c.ID
+		if len(name) > 12 {
+			name = name[:12]
+		}
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		dcont := DockerContainer{
+			ID:          c.ID,
+			Name:        name,
+			Image:       c.Image,
+			State:       c.State,
+			NetworkMode: c.HostConfig.NetworkMode,
+			Ports:       []DockerPort{},
+			Labels:      c.Labels,
+		}
+		seen := make(map[string]bool)
+		for _, p := range c.Ports {
+			// Docker lists a published port once per address family
+			key := fmt.Sprintf("%d/%d/%s", p.PrivatePort, p.PublicPort, p.Type)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			dcont.Ports = append(dcont.Ports, DockerPort{IP: p.IP, PrivatePort: p.PrivatePort, PublicPort: p.PublicPort, Type: p.Type})
+		}
+
+		// Host-network containers publish nothing; their exposed ports are
+		// already host ports
+		if dcont.NetworkMode == "host" {
+			ports, err := dc.exposedPorts(c.ID)
+			if err != nil {
+				log.Printf("docker: failed to inspect %s: %v", name, err)
+			}
+			dcont.Ports = append(dcont.Ports, ports...)
+		}
+		containers = append(containers, dcont)
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	return containers, nil
+}
+
+func (dc *DockerClient) exposedPorts(id string) ([]DockerPort, error) {
+	var inspect struct {
+		Config struct {
+			ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		} `json:"Config"`
+	}
+	if err := dc.get("/containers/"+url.PathEscape(id)+"/json", &inspect); err != nil {
+		return nil, err
+	}
+
+	var ports []DockerPort
+	for spec := range inspect.Config.ExposedPorts {
+		portStr, proto, _ := strings.Cut(spec, "/")
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		if proto == "" {
+			proto = "tcp"
+		}
+		ports = append(ports, DockerPort{PrivatePort: port, PublicPort: port, Type: proto})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].PublicPort < ports[j].PublicPort })
+	return ports, nil
+}
+
+// DockerManager generates proxy suggestions from running containers and
+// keeps label-declared proxies in sync with ConfigManager
+type DockerManager struct {
+	client   *DockerClient
+	config   *ConfigManager
+	interval time.Duration
+	mu       sync.Mutex
+}
+
+func NewDockerManager(client *DockerClient, config *ConfigManager, interval time.Duration) *DockerManager {
+	return &DockerManager{client: client, config: config, interval: interval}
+}
+
+// Run reconciles labels periodically until the process exits
+func (dm *DockerManager) Run() {
+	for {
+		report, err := dm.Reconcile()
+		if err != nil {
+			log.Printf("docker: reconcile failed: %v", err)
+		} else {
+			if len(report.Added)+len(report.Updated)+len(report.Removed) > 0 {
+				log.Printf("docker: reconciled proxies (added %v, updated %v, removed %v)", report.Added, report.Updated, report.Removed)
+			}
+			for _, e := range report.Errors {
+				log.Printf("docker: %s", e)
+			}
+		}
+		time.Sleep(dm.interval)
+	}
+}
+
+func (dm *DockerManager) Containers() ([]DockerContainer, error) {
+	return dm.client.ListContainers()
+}
+
+// Suggestions proposes one proxy per published container port
+func (dm *DockerManager) Suggestions() ([]DockerSuggestion, error) {
+	containers, err := dm.client.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	servers, err := dm.config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := []DockerSuggestion{}
+	for _, c := range containers {
+		for _, port := range c.Ports {
+			if port.PublicPort == 0 {
+				continue
+			}
+			localIP := "127.0.0.1"
+			if ip := net.ParseIP(port.IP); ip != nil && !ip.IsUnspecified() {
+				localIP = port.IP
+			}
+
+			proxyType := "udp"
+			if port.Type != "udp" {
+				proxyType = sniffTCPService(localIP, port.PublicPort)
+			}
+
+			exposed := false
+			for _, s := range servers {
+				for _, p := range s.Proxies {
+					if p.LocalPort == port.PublicPort && proxyTransport(p.Type) == port.Type {
+						exposed = true
+					}
+				}
+			}
+
+			suggestions = append(suggestions, DockerSuggestion{
+				Container: c.Name,
+				Exposed:   exposed,
+				Proxy: ProxyConfig{
+					Name:      fmt.Sprintf("%s-%d", c.Name, port.PrivatePort),
+					Type:      proxyType,
+					LocalIP:   localIP,
+					LocalPort: port.PublicPort,
+				},
+			})
+		}
+	}
+	return suggestions, nil
+}
+
+// Reconcile turns frpc.proxy.* labels into proxies and removes proxies
+// whose container is gone. Only proxies with a docker source are touched.
+func (dm *DockerManager) Reconcile() (*DockerReconcileReport, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	containers, err := dm.client.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DockerReconcileReport{Added: []string{}, Updated: []string{}, Removed: []string{}, Errors: []string{}}
+	var added, updated, removed []string
+	err = dm.config.UpdateAs("docker", "", func(st *State) error {
+		// Validated against the state being changed, so that a concurrent
+		// edit cannot invalidate the checks
+		desired := make(map[string][]ProxyConfig)
+		// Containers with broken labels keep the proxies they already have
+		keep := make(map[string]bool)
+		for _, c := range containers {
+			proxies, serverID, err := labelProxies(c, st.Servers)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("container %s: %v", c.Name, err))
+				keep[dockerSourcePrefix+c.Name] = true
+				continue
+			}
+			if len(proxies) > 0 {
+				desired[serverID] = append(desired[serverID], proxies...)
+			}
+		}
+		added, updated, removed = st.SyncManagedProxies(dockerSourcePrefix, desired, keep)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Added = append(report.Added, added...)
+	report.Updated = append(report.Updated, updated...)
+	report.Removed = append(report.Removed, removed...)
+	return report, nil
+}
+
+// labelProxies returns the proxies declared by a container's labels and
+// the server they belong to, validated like proxies created through the API
+func labelProxies(c DockerContainer, servers []ServerConfig) ([]ProxyConfig, string, error) {
+	proxies, err := proxiesFromLabels(c)
+	if err != nil || len(proxies) == 0 {
+		return nil, "", err
+	}
+	serverID, err := resolveDockerServer(servers, c.Labels[dockerServerLabel])
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The container's current proxies are about to be replaced, so they
+	// do not conflict with the new ones
+	var server ServerConfig
+	for _, s := range servers {
+		if s.ID == serverID {
+			server = s
+		}
+	}
+	others := make([]ProxyConfig, 0, len(server.Proxies))
+	for _, p := range server.Proxies {
+		if p.Source != dockerSourcePrefix+c.Name {
+			others = append(others, p)
+		}
+	}
+	server.Proxies = others
+	for i, p := range proxies {
+		// A temporary ID keeps the label proxies apart from each other
+		p.ID = fmt.Sprintf("label-%d", i)
+		if err := validateProxy(&p, &server); err != nil {
+			return nil, "", fmt.Errorf("%s proxy: %v", p.Type, err)
+		}
+		server.Proxies = append(server.Proxies, p)
+	}
+	return proxies, serverID, nil
+}
+
+// proxiesFromLabels reads labels such as frpc.proxy.http.domain=a.example.com
+// into one proxy per declared type
+func proxiesFromLabels(c DockerContainer) ([]ProxyConfig, error) {
+	byType := make(map[string]*ProxyConfig)
+	var types []string
+
+	for key, value := range c.Labels {
+		if !strings.HasPrefix(key, dockerLabelPrefix) {
+			continue
+		}
+		proxyType, field, ok := strings.Cut(strings.TrimPrefix(key, dockerLabelPrefix), ".")
+		if !ok {
+			return nil, fmt.Errorf("label %s must be %s<type>.<field>", key, dockerLabelPrefix)
+		}
+		switch proxyType {
+		case "tcp", "udp", "http", "https":
+		default:
+			return nil, fmt.Errorf("label %s: unsupported proxy type %q", key, proxyType)
+		}
+
+		p, ok := byType[proxyType]
+		if !ok {
+			p = &ProxyConfig{
+				Name:    c.Name + "-" + proxyType,
+				Type:    proxyType,
+				LocalIP: "127.0.0.1",
+				Source:  dockerSourcePrefix + c.Name,
+			}
+			byType[proxyType] = p
+			types = append(types, proxyType)
+		}
+
+		value = strings.TrimSpace(value)
+		switch field {
+		case "name":
+			p.Name = value
+		case "domain", "domains", "customDomains":
+			for _, d := range strings.Split(value, ",") {
+				if d = strings.TrimSpace(d); d != "" {
+					p.CustomDomains = append(p.CustomDomains, d)
+				}
+			}
+		case "subdomain":
+			p.Subdomain = value
+		case "localIP":
+			p.LocalIP = value
+		case "localPort", "remotePort":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("label %s: invalid port %q", key, value)
+			}
+			if field == "localPort" {
+				p.LocalPort = port
+			} else {
+				p.RemotePort = port
+			}
+		default:
+			return nil, fmt.Errorf("label %s: unknown field %q", key, field)
+		}
+	}
+
+	sort.Strings(types)
+	proxies := make([]ProxyConfig, 0, len(types))
+	for _, t := range types {
+		p := byType[t]
+		if p.LocalPort == 0 {
+			p.LocalPort = defaultContainerPort(c, p.Type)
+		}
+		if p.LocalPort == 0 {
+			return nil, fmt.Errorf("%s proxy has no localPort label and no published port to use", p.Type)
+		}
+		proxies = append(proxies, *p)
+	}
+	return proxies, nil
+}
+
+// defaultContainerPort picks the host port of the first published port
+// with a matching protocol, preferring 80/443 for http/https
+func defaultContainerPort(c DockerContainer, proxyType string) int {
+	transport := proxyTransport(proxyType)
+	preferred := map[string]int{"http": 80, "https": 443}[proxyType]
+
+	first := 0
+	for _, port := range c.Ports {
+		if port.Type != transport || port.PublicPort == 0 {
+			continue
+		}
+		if port.PrivatePort == preferred {
+			return port.PublicPort
+		}
+		if first == 0 {
+			first = port.PublicPort
+		}
+	}
+	return first
+}
+
+// resolveDockerServer finds the server named by the frpc.server label, by
+// ID or name; without a label the only configured server is used
+func resolveDockerServer(servers []ServerConfig, ref string) (string, error) {
+	if ref == "" {
+		if len(servers) == 1 {
+			return servers[0].ID, nil
+		}
+		return "", fmt.Errorf("label %s is required when %d servers are configured", dockerServerLabel, len(servers))
+	}
+	for _, s := range servers {
+		if s.ID == ref || s.Name == ref {
+			return s.ID, nil
+		}
+	}
+	return "", fmt.Errorf("server %q from label %s not found", ref, dockerServerLabel)
+}
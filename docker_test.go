@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves /containers/json on a Unix socket
+type fakeDocker struct {
+	labels map[string]map[string]string // container name to labels
+	mu     sync.Mutex
+}
+
+func (fd *fakeDocker) set(name string, labels map[string]string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if labels == nil {
+		delete(fd.labels, name)
+		return
+	}
+	fd.labels[name] = labels
+}
+
+func (fd *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/containers/json" {
+		http.NotFound(w, r)
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	list := []map[string]interface{}{}
+	for name, labels := range fd.labels {
+		list = append(list, map[string]interface{}{
+			"Id":         name + "0123456789abcdef",
+			"Names":      []string{"/" + name},
+			"Image":      "nginx",
+			"State":      "running",
+			"Ports":      []map[string]interface{}{{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 8080, "Type": "tcp"}},
+			"Labels":     labels,
+			"HostConfig": map[string]string{"NetworkMode": "bridge"},
+		})
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, *DockerClient) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	fd := &fakeDocker{labels: make(map[string]map[string]string)}
+	srv := &http.Server{Handler: fd}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return fd, NewDockerClient(socket)
+}
+
+// dockerProxies returns the docker-managed proxies of a server by name
+func dockerProxies(t *testing.T, cm *ConfigManager, serverID string) map[string]ProxyConfig {
+	t.Helper()
+	server, err := cm.GetServer(serverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies := make(map[string]ProxyConfig)
+	for _, p := range server.Proxies {
+		if p.Source != "" {
+			proxies[p.Name] = p
+		}
+	}
+	return proxies
+}
+
+func TestDockerReconcile(t *testing.T) {
+	fd, client := newFakeDocker(t)
+	cm, _ := newTestConfigManager(t)
+	serverID := addTestServer(t, cm, "home")
+	dm := NewDockerManager(client, cm, time.Minute)
+
+	reconcile := func() *DockerReconcileReport {
+		t.Helper()
+		report, err := dm.Reconcile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	fd.set("a", map[string]string{"frpc.proxy.http.domain": "a.example.com"})
+	report := reconcile()
+	proxies := dockerProxies(t, cm, serverID)
+	web, ok := proxies["a-http"]
+	if !ok || len(report.Added) != 1 {
+		t.Fatalf("a-http not added: %+v, proxies %v", report, proxies)
+	}
+	if web.LocalPort != 8080 || web.CustomDomains[0] != "a.example.com" {
+		t.Fatalf("unexpected proxy %+v", web)
+	}
+
+	// Broken labels are reported and leave the existing proxy in place
+	broken := []map[string]string{
+		{"frpc.proxy.http.domain": "a.example.com", "frpc.proxy.http.bogus": "1"},
+		{"frpc.proxy.http.domain": "a.example.com", "frpc.server": "nope"},
+		{"frpc.proxy.http.domain": "a.example.com\"\n[webServer]\nport = 1\n#"},
+		{"frpc.proxy.http.domain": "a.example.com", "frpc.proxy.http.localIP": "bad\"ip"},
+	}
+	for _, labels := range broken {
+		fd.set("a", labels)
+		report := reconcile()
+		if len(report.Errors) != 1 || len(report.Removed) != 0 || len(report.Updated) != 0 {
+			t.Fatalf("labels %v: unexpected report %+v", labels, report)
+		}
+		kept, ok := dockerProxies(t, cm, serverID)["a-http"]
+		if !ok || kept.ID != web.ID || kept.CustomDomains[0] != "a.example.com" {
+			t.Fatalf("labels %v: a-http was not kept: %+v", labels, kept)
+		}
+	}
+
+	// Label proxies conflict with user proxies like any other
+	err := cm.Update(func(st *State) error {
+		_, err := st.AddProxy(serverID, ProxyConfig{Name: "ssh", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 22, RemotePort: 6000})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.set("b", map[string]string{"frpc.proxy.tcp.remotePort": "6000"})
+	fd.set("a", map[string]string{"frpc.proxy.http.domain": "a.example.com"})
+	report = reconcile()
+	if len(report.Errors) != 1 {
+		t.Fatalf("remote port conflict not reported: %+v", report)
+	}
+	if _, ok := dockerProxies(t, cm, serverID)["b-tcp"]; ok {
+		t.Fatal("b-tcp was added despite its remote port conflict")
+	}
+
+	// Once the container is gone its proxies go too
+	fd.set("a", nil)
+	fd.set("b", nil)
+	report = reconcile()
+	if len(report.Removed) != 1 || len(dockerProxies(t, cm, serverID)) != 0 {
+		t.Fatalf("a-http not removed: %+v", report)
+	}
+}
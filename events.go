@@ -0,0 +1,206 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHistorySize is how many parsed events are kept per server
+const eventHistorySize = 500
+
+// LogEvent is a parsed line of frpc output
+type LogEvent struct {
+	ID       int64  `json:"id"` // increases per server; use with ?after=
+	Time     string `json:"time"`
+	Level    string `json:"level"` // trace, debug, info, warn, error
+	Category string `json:"category"`
+	Proxy    string `json:"proxy,omitempty"`
+	Source   string `json:"source,omitempty"` // frpc source file, e.g. client/service.go:295
+	Message  string `json:"message"`
+
+	at time.Time // parsed timestamp; zero if the line has none
+}
+
+// Event categories. Lines that match none are "other".
+const (
+	eventLogin          = "login"
+	eventLoginFailed    = "login_failed"
+	eventConnectFailed  = "connect_failed"
+	eventReconnecting   = "reconnecting"
+	eventDisconnected   = "disconnected"
+	eventProxyStarted   = "proxy_started"
+	eventProxyFailed    = "proxy_failed"
+	eventProxyAdded     = "proxy_added"
+	eventProxyRemoved   = "proxy_removed"
+	eventReloaded       = "reloaded"
+	eventServiceStarted = "service_started"
+	eventProcess        = "process" // lines written by the supervisor
+	eventOther          = "other"
+)
+
+var (
+	// 2024-01-02 15:04:05.000 [I] [client/service.go:295] [runid] [proxy] message
+	frpcLogRe = regexp.MustCompile(`^(?:(\d{4}[-/]\d{2}[-/]\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) )?\[([TDIWE])\] \[([^\]]*)\] (.*)$`)
+	runIDRe   = regexp.MustCompile(`^[0-9a-f]{8,32}$`)
+	ansiRe    = regexp.MustCompile(`\x1b\[[0-9;]*m`) // frpc colors console output
+
+	// Checked in order; the first match wins
+	eventPatterns = []struct {
+		category string
+		re       *regexp.Regexp
+	}{
+		{eventLogin, regexp.MustCompile(`(?i)login to (the )?server success`)},
+		{eventLoginFailed, regexp.MustCompile(`(?i)login to (the )?server fail`)},
+		{eventProxyStarted, regexp.MustCompile(`(?i)start proxy success`)},
+		{eventProxyFailed, regexp.MustCompile(`(?i)start error`)},
+		{eventProxyAdded, regexp.MustCompile(`(?i)proxy added`)},
+		{eventProxyRemoved, regexp.MustCompile(`(?i)proxy removed|proxy closing`)},
+		{eventConnectFailed, regexp.MustCompile(`(?i)connect to server error|dial tcp|connection refused|i/o timeout`)},
+		{eventReconnecting, regexp.MustCompile(`(?i)try to (re)?connect`)},
+		{eventDisconnected, regexp.MustCompile(`(?i)control is closed|control writer is closing|heartbeat timeout|session shutdown`)},
+		{eventReloaded, regexp.MustCompile(`(?i)success reload conf`)},
+		{eventServiceStarted, regexp.MustCompile(`(?i)start frpc service`)},
+	}
+
+	frpcLevels = map[string]string{"T": "trace", "D": "debug", "I": "info", "W": "warn", "E": "error"}
+	eventRanks = map[string]int{"trace": 0, "debug": 1, "info": 2, "warn": 3, "error": 4}
+)
+
+// parseLogLine turns a line of frpc output into an event. Time is left
+// empty when the line carries no timestamp. Blank lines yield false.
+func parseLogLine(text string) (LogEvent, bool) {
+	text = strings.TrimSpace(ansiRe.ReplaceAllString(text, ""))
+	if text == "" {
+		return LogEvent{}, false
+	}
+	ev := LogEvent{Level: "info", Category: eventOther, Message: text}
+
+	// Markers written by spawn: --- 2006-01-02 15:04:05 started ---
+	if strings.HasPrefix(text, "--- ") && strings.HasSuffix(text, " ---") {
+		ev.setTime("2006-01-02 15:04:05", text[4:min(len(text), 23)])
+		ev.Category = eventProcess
+		if strings.Contains(text, "restarted after") {
+			ev.Level = "warn"
+		}
+		return ev, true
+	}
+
+	m := frpcLogRe.FindStringSubmatch(text)
+	if m == nil {
+		if strings.HasPrefix(text, "panic:") || strings.HasPrefix(text, "fatal error:") {
+			ev.Level = "error"
+		}
+		return ev, true
+	}
+	if m[1] != "" {
+		layout := "2006-01-02 15:04:05"
+		if strings.Contains(m[1], "/") {
+			layout = "2006/01/02 15:04:05"
+		}
+		ev.setTime(layout, m[1])
+	}
+	ev.Level = frpcLevels[m[2]]
+	ev.Source = m[3]
+
+	// Leading [run ID] and [proxy name] prefixes
+	msg := m[4]
+	var tags []string
+	for strings.HasPrefix(msg, "[") {
+		end := strings.Index(msg, "] ")
+		if end < 0 {
+			break
+		}
+		tags = append(tags, msg[1:end])
+		msg = msg[end+2:]
+	}
+	switch {
+	case len(tags) >= 2:
+		ev.Proxy = tags[1]
+	case len(tags) == 1 && !runIDRe.MatchString(tags[0]):
+		ev.Proxy = tags[0]
+	}
+	ev.Message = msg
+
+	for _, p := range eventPatterns {
+		if p.re.MatchString(msg) {
+			ev.Category = p.category
+			break
+		}
+	}
+	return ev, true
+}
+
+func (ev *LogEvent) setTime(layout, value string) {
+	if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+		ev.at = t
+		ev.Time = t.Format(time.RFC3339)
+	}
+}
+
+// EventQuery filters events; zero values match everything
+type EventQuery struct {
+	Level    string // minimum level
+	Category string
+	Proxy    string
+	After    int64 // only events with a larger ID
+	Limit    int   // newest events first to keep
+}
+
+// EventLog keeps the recent events of each server
+type EventLog struct {
+	events map[string][]LogEvent // oldest first
+	mu     sync.Mutex
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{events: make(map[string][]LogEvent)}
+}
+
+// Record parses a line published by the log hub and returns its event
+func (el *EventLog) Record(serverID string, line LogLine) (LogEvent, bool) {
+	ev, ok := parseLogLine(line.Text)
+	if !ok {
+		return ev, false
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().Format(time.RFC3339)
+	}
+	ev.ID = line.seq
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	events := append(el.events[serverID], ev)
+	if len(events) > 2*eventHistorySize {
+		events = append([]LogEvent(nil), events[len(events)-eventHistorySize:]...)
+	}
+	el.events[serverID] = events
+	return ev, true
+}
+
+// Query returns matching events, oldest first
+func (el *EventLog) Query(serverID string, q EventQuery) []LogEvent {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	events := el.events[serverID]
+	if len(events) > eventHistorySize {
+		events = events[len(events)-eventHistorySize:]
+	}
+	minRank := eventRanks[q.Level]
+	result := []LogEvent{}
+	for _, ev := range events {
+		if ev.ID <= q.After || eventRanks[ev.Level] < minRank {
+			continue
+		}
+		if (q.Category != "" && ev.Category != q.Category) || (q.Proxy != "" && ev.Proxy != q.Proxy) {
+			continue
+		}
+		result = append(result, ev)
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
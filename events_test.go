@@ -0,0 +1,127 @@
+package main
+
+import "testing"
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		ok       bool
+		time     string // local time as written
+		level    string
+		category string
+		proxy    string
+		source   string
+		message  string
+	}{
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{
+			line: "2024-01-02 15:04:05.123 [I] [client/service.go:295] [0123456789abcdef] login to server success, get run id [0123456789abcdef]",
+			ok:   true, time: "2024-01-02 15:04:05", level: "info", category: eventLogin, source: "client/service.go:295",
+			message: "login to server success, get run id [0123456789abcdef]",
+		},
+		{
+			line: "2024/01/02 15:04:05 [W] [client/service.go:301] login to the server failed: authorization failed",
+			ok:   true, time: "2024-01-02 15:04:05", level: "warn", category: eventLoginFailed, source: "client/service.go:301",
+			message: "login to the server failed: authorization failed",
+		},
+		{
+			line: "2024-01-02 15:04:05.000 [I] [proxy/proxy_manager.go:173] [0123456789abcdef] [web] start proxy success",
+			ok:   true, time: "2024-01-02 15:04:05", level: "info", category: eventProxyStarted, proxy: "web", source: "proxy/proxy_manager.go:173",
+			message: "start proxy success",
+		},
+		{
+			// A single tag that is not a run ID is the proxy
+			line: "2024-01-02 15:04:05 [E] [client/proxy.go:10] [ssh] start error: port already used",
+			ok:   true, time: "2024-01-02 15:04:05", level: "error", category: eventProxyFailed, proxy: "ssh", source: "client/proxy.go:10",
+			message: "start error: port already used",
+		},
+		{
+			line: "\x1b[1;34m2024-01-02 15:04:05 [W] [client/control.go:1] [0123456789abcdef] heartbeat timeout\x1b[0m",
+			ok:   true, time: "2024-01-02 15:04:05", level: "warn", category: eventDisconnected, source: "client/control.go:1",
+			message: "heartbeat timeout",
+		},
+		{
+			line: "[D] [client/service.go:1] try to connect to server...",
+			ok:   true, level: "debug", category: eventReconnecting, source: "client/service.go:1",
+			message: "try to connect to server...",
+		},
+		{
+			line: "2024-01-02 15:04:05 [W] [client/service.go:1] connect to server error: dial tcp 1.2.3.4:7000: connection refused",
+			ok:   true, time: "2024-01-02 15:04:05", level: "warn", category: eventConnectFailed, source: "client/service.go:1",
+			message: "connect to server error: dial tcp 1.2.3.4:7000: connection refused",
+		},
+		{
+			line: "--- 2024-01-02 15:04:05 started ---",
+			ok:   true, time: "2024-01-02 15:04:05", level: "info", category: eventProcess,
+			message: "--- 2024-01-02 15:04:05 started ---",
+		},
+		{
+			line: "--- 2024-01-02 15:04:05 restarted after: exit status 1 ---",
+			ok:   true, time: "2024-01-02 15:04:05", level: "warn", category: eventProcess,
+			message: "--- 2024-01-02 15:04:05 restarted after: exit status 1 ---",
+		},
+		{line: "panic: runtime error", ok: true, level: "error", category: eventOther, message: "panic: runtime error"},
+		{line: "some unrelated output", ok: true, level: "info", category: eventOther, message: "some unrelated output"},
+	}
+	for _, tt := range tests {
+		ev, ok := parseLogLine(tt.line)
+		if ok != tt.ok {
+			t.Errorf("%q: ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		when := ""
+		if !ev.at.IsZero() {
+			when = ev.at.Format("2006-01-02 15:04:05")
+		}
+		if when != tt.time || ev.Level != tt.level || ev.Category != tt.category || ev.Proxy != tt.proxy || ev.Source != tt.source || ev.Message != tt.message {
+			t.Errorf("%q:\n got time=%q level=%q category=%q proxy=%q source=%q message=%q\nwant time=%q level=%q category=%q proxy=%q source=%q message=%q",
+				tt.line, when, ev.Level, ev.Category, ev.Proxy, ev.Source, ev.Message,
+				tt.time, tt.level, tt.category, tt.proxy, tt.source, tt.message)
+		}
+	}
+}
+
+func TestEventLogQuery(t *testing.T) {
+	el := NewEventLog()
+	lines := []string{
+		"2024-01-02 15:04:05 [I] [client/service.go:1] [0123456789abcdef] login to server success",
+		"2024-01-02 15:04:06 [I] [proxy/proxy.go:1] [0123456789abcdef] [web] start proxy success",
+		"2024-01-02 15:04:07 [W] [proxy/proxy.go:1] [0123456789abcdef] [ssh] start error: port used",
+		"2024-01-02 15:04:08 [E] [client/control.go:1] [0123456789abcdef] heartbeat timeout",
+	}
+	for i, text := range lines {
+		el.Record("s", LogLine{Text: text, seq: int64(i + 1)})
+	}
+
+	tests := []struct {
+		q    EventQuery
+		want []int64
+	}{
+		{EventQuery{}, []int64{1, 2, 3, 4}},
+		{EventQuery{Level: "warn"}, []int64{3, 4}},
+		{EventQuery{Category: eventProxyStarted}, []int64{2}},
+		{EventQuery{Proxy: "ssh"}, []int64{3}},
+		{EventQuery{After: 2}, []int64{3, 4}},
+		{EventQuery{Limit: 1}, []int64{4}},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, ev := range el.Query("s", tt.q) {
+			got = append(got, ev.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.q, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%+v: got %v, want %v", tt.q, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// fsyncs it and renames it over path, so a crash leaves either the old or
+// the new content but never a truncated file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		// Not supported on every platform; the umask default is acceptable there
+		log.Printf("Failed to set mode on %s: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir persists a rename; directories cannot be synced on Windows, so
+// errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func backupPath(path string) string {
+	return path + ".bak"
+}
+
+// writeJSONFile atomically replaces a JSON file, first keeping its current
+// content as path.bak when that content is valid. The first write seeds
+// the backup with the new content so there is always a good copy.
+func writeJSONFile(path string, data []byte, perm os.FileMode) error {
+	prev, err := os.ReadFile(path)
+	if err == nil && json.Valid(prev) {
+		if err := writeFileAtomic(backupPath(path), prev, perm); err != nil {
+			return fmt.Errorf("failed to back up %s: %v", filepath.Base(path), err)
+		}
+	} else if os.IsNotExist(err) {
+		if err := writeFileAtomic(backupPath(path), data, perm); err != nil {
+			return fmt.Errorf("failed to back up %s: %v", filepath.Base(path), err)
+		}
+	}
+	return writeFileAtomic(path, data, perm)
+}
+
+// readJSONFile decodes path into v. If the file is corrupt, the last good
+// copy is decoded instead and restored over the damaged file.
+func readJSONFile(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	jsonErr := json.Unmarshal(b, v)
+	if jsonErr == nil {
+		return nil
+	}
+
+	bak, err := os.ReadFile(backupPath(path))
+	if err != nil {
+		return fmt.Errorf("%s is corrupt (%v) and no backup is available", filepath.Base(path), jsonErr)
+	}
+	if err := json.Unmarshal(bak, v); err != nil {
+		return fmt.Errorf("%s is corrupt (%v) and so is its backup", filepath.Base(path), jsonErr)
+	}
+
+	// Keep the damaged file around for inspection
+	os.WriteFile(path+".corrupt", b, 0600)
+	if err := writeFileAtomic(path, bak, 0600); err != nil {
+		log.Printf("Failed to restore %s from backup: %v", path, err)
+	} else {
+		log.Printf("%s was corrupt (%v); restored last good copy", path, jsonErr)
+	}
+	return nil
+}
+
+// removeStaleTemps deletes temp files left behind by a crash mid-write.
+// It must only run before anything writes to dir.
+func removeStaleTemps(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	for _, m := range matches {
+		log.Printf("Removing incomplete write %s", m)
+		os.Remove(m)
+	}
+}
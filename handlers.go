@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Handler struct {
@@ -11,10 +17,16 @@ type Handler struct {
 	process *ProcessManager
 	version *VersionManager
 	auth    *AuthManager
+	vars    *VariableStore
+	history *HistoryManager
+	docker  *DockerManager // nil unless the Docker integration is enabled
+	watcher *ConfigWatcher // nil when external edits are not watched
+	applier *Applier
+	metrics *MetricsSampler // nil where /proc is unavailable
 }
 
-func NewHandler(config *ConfigManager, process *ProcessManager, version *VersionManager, auth *AuthManager) *Handler {
-	return &Handler{config: config, process: process, version: version, auth: auth}
+func NewHandler(config *ConfigManager, process *ProcessManager, version *VersionManager, auth *AuthManager, vars *VariableStore, history *HistoryManager, docker *DockerManager, watcher *ConfigWatcher, applier *Applier, metrics *MetricsSampler) *Handler {
+	return &Handler{config: config, process: process, version: version, auth: auth, vars: vars, history: history, docker: docker, watcher: watcher, applier: applier, metrics: metrics}
 }
 
 func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
@@ -27,6 +39,53 @@ func jsonError(w http.ResponseWriter, status int, msg string) {
 	jsonResponse(w, status, map[string]string{"error": msg})
 }
 
+// errInvalidRequest marks config update failures caused by the request
+var errInvalidRequest = errors.New("invalid request")
+
+// configError reports a failed config update: 422 with field errors for
+// invalid values, 412 for a stale If-Match
+func configError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		jsonResponse(w, 422, map[string]interface{}{"error": "validation failed", "errors": verr.Errors})
+		return
+	}
+	if errors.Is(err, errRevisionMismatch) {
+		jsonError(w, 412, err.Error())
+		return
+	}
+	if errors.Is(err, errNotFound) {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidRequest) {
+		jsonError(w, 400, strings.TrimPrefix(err.Error(), errInvalidRequest.Error()+": "))
+		return
+	}
+	jsonError(w, 500, err.Error())
+}
+
+// etag formats a revision as a strong entity tag
+func etag(rev int64) string {
+	return fmt.Sprintf("\"%d\"", rev)
+}
+
+// checkIfMatch fails with errRevisionMismatch when the request carries an
+// If-Match header that does not name rev. Requests without one always pass.
+func checkIfMatch(r *http.Request, rev int64) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(rev) {
+			return nil
+		}
+	}
+	return errRevisionMismatch
+}
+
 // --- Auth ---
 
 func (h *Handler) AuthStatus(w http.ResponseWriter, r *http.Request) {
@@ -88,6 +147,18 @@ func (h *Handler) AuthLogin(w http.ResponseWriter, r *http.Request) {
 
 // --- Servers ---
 
+// ServerView is the API form of a ServerConfig. Secrets are write-only: the
+// token itself is never returned, only whether one is set.
+type ServerView struct {
+	ServerConfig
+	AuthToken       string `json:"authToken,omitempty"`
+	AuthTokenStatus string `json:"authTokenStatus"`
+}
+
+func newServerView(s ServerConfig) ServerView {
+	return ServerView{ServerConfig: s, AuthTokenStatus: secretStatus(s.AuthToken)}
+}
+
 func (h *Handler) ListServers(w http.ResponseWriter, r *http.Request) {
 	servers, err := h.config.Load()
 	if err != nil {
@@ -97,20 +168,42 @@ func (h *Handler) ListServers(w http.ResponseWriter, r *http.Request) {
 
 	// Attach running status
 	type ServerWithStatus struct {
-		ServerConfig
-		Running bool `json:"running"`
-		PID     int  `json:"pid"`
+		ServerView
+		Running     bool             `json:"running"`
+		PID         int              `json:"pid"`
+		ConfigDirty bool             `json:"configDirty"` // running with outdated config
+		Supervisor  SupervisorStatus `json:"supervisor"`
+		Connection  ConnectionStatus `json:"connection"`
 	}
 
 	result := make([]ServerWithStatus, len(servers))
 	for i, s := range servers {
 		running, pid := h.process.Status(s.ID)
-		result[i] = ServerWithStatus{ServerConfig: s, Running: running, PID: pid}
+		_, _, dirty := h.applier.Pending(&s)
+		result[i] = ServerWithStatus{
+			ServerView:  newServerView(s),
+			Running:     running,
+			PID:         pid,
+			ConfigDirty: dirty,
+			Supervisor:  h.process.Supervision(s.ID),
+			Connection:  h.process.Connection(s.ID),
+		}
 	}
 
 	jsonResponse(w, 200, result)
 }
 
+// GetServer returns one server with its revision as ETag
+func (h *Handler) GetServer(w http.ResponseWriter, r *http.Request) {
+	server, err := h.config.GetServer(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag(server.Revision))
+	jsonResponse(w, 200, newServerView(*server))
+}
+
 func (h *Handler) CreateServer(w http.ResponseWriter, r *http.Request) {
 	var cfg ServerConfig
 	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
@@ -118,12 +211,16 @@ func (h *Handler) CreateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cfg.Name == "" || cfg.ServerAddr == "" || cfg.ServerPort == 0 {
-		jsonError(w, 400, "name, serverAddr, and serverPort are required")
+	if err := validateServer(&cfg); err != nil {
+		configError(w, err)
 		return
 	}
 
-	if err := h.config.CreateServer(cfg); err != nil {
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		st.AddServer(cfg)
+		return nil
+	})
+	if err != nil {
 		jsonError(w, 500, err.Error())
 		return
 	}
@@ -133,32 +230,138 @@ func (h *Handler) CreateServer(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) UpdateServer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	var cfg ServerConfig
-	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+	var body struct {
+		ServerConfig
+		ClearAuthToken bool `json:"clearAuthToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		jsonError(w, 400, "invalid request body")
 		return
 	}
 
-	if err := h.config.UpdateServer(id, cfg); err != nil {
-		jsonError(w, 500, err.Error())
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		server, err := st.Server(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, server.Revision); err != nil {
+			return err
+		}
+		if err := validateServer(&body.ServerConfig); err != nil {
+			return err
+		}
+		return st.UpdateServer(id, body.ServerConfig, body.ClearAuthToken)
+	})
+	if err != nil {
+		configError(w, err)
+		return
+	}
+
+	jsonResponse(w, 200, map[string]string{"status": "updated"})
+}
+
+// PatchServer applies an RFC 7396 merge patch to a server. Omitted fields
+// are kept; "authToken": null clears the token.
+func (h *Handler) PatchServer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, 400, "invalid request body")
+		return
+	}
+
+	err = h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		server, err := st.Server(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, server.Revision); err != nil {
+			return err
+		}
+
+		next := *server
+		if err := applyMergePatch(&next, patch); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidRequest, err)
+		}
+		// Proxies have their own endpoints; bookkeeping fields are ours
+		next.ID = server.ID
+		next.Proxies = server.Proxies
+		next.CreatedAt = server.CreatedAt
+		next.Revision = server.Revision
+		next.UpdatedAt = time.Now().Format(time.RFC3339)
+		if err := validateServer(&next); err != nil {
+			return err
+		}
+		*server = next
+		return nil
+	})
+	if err != nil {
+		configError(w, err)
 		return
 	}
 
 	jsonResponse(w, 200, map[string]string{"status": "updated"})
 }
 
+// PreviewServer shows the frpc config with every placeholder resolved the
+// way frpc would see it; the auth token and secret variables stay hidden
+func (h *Handler) PreviewServer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	server, err := h.config.GetServer(id)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+
+	rendered, missing, err := h.config.RenderMasked(server, true)
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+
+	jsonResponse(w, 200, map[string]interface{}{
+		"toml":    formatToml(rendered),
+		"missing": missing,
+	})
+}
+
 func (h *Handler) DeleteServer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		server, err := st.Server(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, server.Revision); err != nil {
+			return err
+		}
+		return st.DeleteServer(id)
+	})
+	if err != nil {
+		configError(w, err)
+		return
+	}
+
 	// Stop if running
 	h.process.Stop(id)
 
-	if err := h.config.DeleteServer(id); err != nil {
+	jsonResponse(w, 200, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) DiagnoseServer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	server, err := h.config.GetServer(id)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	rendered, _, err := h.config.RenderServer(server, true)
+	if err != nil {
 		jsonError(w, 500, err.Error())
 		return
 	}
-
-	jsonResponse(w, 200, map[string]string{"status": "deleted"})
+	jsonResponse(w, 200, DiagnoseServer(rendered))
 }
 
 // --- Proxies ---
@@ -173,6 +376,22 @@ func (h *Handler) ListProxies(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, 200, server.Proxies)
 }
 
+// GetProxy returns one proxy with its revision as ETag
+func (h *Handler) GetProxy(w http.ResponseWriter, r *http.Request) {
+	server, err := h.config.GetServer(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	proxy, err := server.Proxy(r.PathValue("pid"))
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag(proxy.Revision))
+	jsonResponse(w, 200, proxy)
+}
+
 func (h *Handler) CreateProxy(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	var proxy ProxyConfig
@@ -181,13 +400,22 @@ func (h *Handler) CreateProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proxy.Name == "" || proxy.Type == "" {
-		jsonError(w, 400, "name and type are required")
-		return
-	}
+	proxy.ID = ""
+	proxy.Source = ""
 
-	if err := h.config.AddProxy(id, proxy); err != nil {
-		jsonError(w, 500, err.Error())
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		server, err := st.Server(id)
+		if err != nil {
+			return err
+		}
+		if err := validateProxy(&proxy, server); err != nil {
+			return err
+		}
+		_, err = st.AddProxy(id, proxy)
+		return err
+	})
+	if err != nil {
+		configError(w, err)
 		return
 	}
 
@@ -204,8 +432,64 @@ func (h *Handler) UpdateProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.config.UpdateProxy(id, pid, proxy); err != nil {
-		jsonError(w, 500, err.Error())
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		if err := checkProxyIfMatch(r, st, id, pid); err != nil {
+			return err
+		}
+		server, _ := st.Server(id)
+		proxy.ID = pid
+		if err := validateProxy(&proxy, server); err != nil {
+			return err
+		}
+		return st.UpdateProxy(id, pid, proxy)
+	})
+	if err != nil {
+		configError(w, err)
+		return
+	}
+
+	jsonResponse(w, 200, map[string]string{"status": "updated"})
+}
+
+// PatchProxy applies an RFC 7396 merge patch to a proxy
+func (h *Handler) PatchProxy(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	pid := r.PathValue("pid")
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, 400, "invalid request body")
+		return
+	}
+
+	err = h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		server, err := st.Server(id)
+		if err != nil {
+			return err
+		}
+		proxy, err := server.Proxy(pid)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(r, proxy.Revision); err != nil {
+			return err
+		}
+
+		next := *proxy
+		if err := applyMergePatch(&next, patch); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidRequest, err)
+		}
+		next.ID = proxy.ID
+		next.Source = proxy.Source
+		next.Revision = proxy.Revision
+		if err := validateProxy(&next, server); err != nil {
+			return err
+		}
+		*proxy = next
+		server.UpdatedAt = time.Now().Format(time.RFC3339)
+		return nil
+	})
+	if err != nil {
+		configError(w, err)
 		return
 	}
 
@@ -216,14 +500,72 @@ func (h *Handler) DeleteProxy(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	pid := r.PathValue("pid")
 
-	if err := h.config.DeleteProxy(id, pid); err != nil {
-		jsonError(w, 500, err.Error())
+	err := h.config.UpdateAs(requestActor(r), "", func(st *State) error {
+		if err := checkProxyIfMatch(r, st, id, pid); err != nil {
+			return err
+		}
+		return st.DeleteProxy(id, pid)
+	})
+	if err != nil {
+		configError(w, err)
 		return
 	}
 
 	jsonResponse(w, 200, map[string]string{"status": "deleted"})
 }
 
+func checkProxyIfMatch(r *http.Request, st *State, serverID, proxyID string) error {
+	server, err := st.Server(serverID)
+	if err != nil {
+		return err
+	}
+	proxy, err := server.Proxy(proxyID)
+	if err != nil {
+		return err
+	}
+	return checkIfMatch(r, proxy.Revision)
+}
+
+func (h *Handler) ProbeProxy(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	pid := r.PathValue("pid")
+
+	server, err := h.config.GetServer(id)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+
+	rendered, _, err := h.config.RenderServer(server, true)
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+	for _, p := range rendered.Proxies {
+		if p.ID == pid {
+			jsonResponse(w, 200, ProbeProxy(p))
+			return
+		}
+	}
+	jsonError(w, 404, "proxy not found: "+pid)
+}
+
+func (h *Handler) DiscoverServices(w http.ResponseWriter, r *http.Request) {
+	servers, err := h.config.Load()
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+
+	probe := r.URL.Query().Get("probe") != "false"
+	services, err := DiscoverServices(servers, probe)
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, 200, services)
+}
+
 // --- Process Control ---
 
 func (h *Handler) StartServer(w http.ResponseWriter, r *http.Request) {
@@ -234,6 +576,16 @@ func (h *Handler) StartServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.config.CheckRunnable(server); err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			configError(w, err)
+			return
+		}
+		jsonError(w, 400, err.Error())
+		return
+	}
+
 	toml := h.config.GenerateToml(server)
 	if err := h.process.Start(id, toml); err != nil {
 		jsonError(w, 500, err.Error())
@@ -243,6 +595,20 @@ func (h *Handler) StartServer(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, 200, map[string]string{"status": "started"})
 }
 
+// restartServer stops a running server and starts it with freshly
+// generated config
+func restartServer(cm *ConfigManager, pm *ProcessManager, server *ServerConfig) error {
+	if err := cm.CheckRunnable(server); err != nil {
+		return err
+	}
+	if running, _ := pm.Status(server.ID); running {
+		if err := pm.Stop(server.ID); err != nil {
+			return err
+		}
+	}
+	return pm.Start(server.ID, cm.GenerateToml(server))
+}
+
 func (h *Handler) StopServer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if err := h.process.Stop(id); err != nil {
@@ -255,20 +621,497 @@ func (h *Handler) StopServer(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ServerStatus(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	running, pid := h.process.Status(id)
+	dirty := false
+	if server, err := h.config.GetServer(id); err == nil {
+		_, _, dirty = h.applier.Pending(server)
+	}
+	var metrics *MetricsReport
+	if h.metrics != nil && running {
+		metrics = h.metrics.Metrics(id)
+	}
 	jsonResponse(w, 200, map[string]interface{}{
-		"running": running,
-		"pid":     pid,
+		"running":     running,
+		"pid":         pid,
+		"configDirty": dirty,
+		"supervisor":  h.process.Supervision(id),
+		"connection":  h.process.Connection(id),
+		"metrics":     metrics,
 	})
 }
 
+// PendingChanges shows how the config of a running server differs from
+// what it runs
+func (h *Handler) PendingChanges(w http.ResponseWriter, r *http.Request) {
+	server, err := h.config.GetServer(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	running, pending, dirty := h.applier.Pending(server)
+	isRunning, _ := h.process.Status(server.ID)
+	diff := ""
+	if dirty {
+		secrets := h.config.SecretValues()
+		diff = unifiedDiff(maskToml(running, secrets), maskToml(pending, secrets), "running", "pending")
+	}
+	jsonResponse(w, 200, map[string]interface{}{
+		"running":     isRunning,
+		"configDirty": dirty,
+		"applyPolicy": server.ApplyPolicy,
+		"diff":        diff,
+	})
+}
+
+// ApplyChanges applies pending config to a running server. ?mode= selects
+// restart or reload; the default is the server's policy, or restart.
+func (h *Handler) ApplyChanges(w http.ResponseWriter, r *http.Request) {
+	server, err := h.config.GetServer(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	if running, _ := h.process.Status(server.ID); !running {
+		jsonError(w, 409, "server is not running")
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = server.ApplyPolicy
+	}
+	switch mode {
+	case applyRestart, applyReload:
+	case "", applyManual:
+		mode = applyRestart
+	default:
+		jsonError(w, 400, "mode must be restart or reload")
+		return
+	}
+
+	used, err := h.applier.Apply(server, mode)
+	if err != nil {
+		configError(w, err)
+		return
+	}
+	if used == "" {
+		jsonResponse(w, 200, map[string]string{"status": "unchanged"})
+		return
+	}
+	jsonResponse(w, 200, map[string]string{"status": "applied", "mode": used})
+}
+
+// ServerLogs returns a page of a server's log, newest lines by default.
+// Lines can be filtered by level, proxy, text, regex and time range; the
+// returned nextCursor fetches the page of older matches.
 func (h *Handler) ServerLogs(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	logs, err := h.process.GetLogs(id, 200)
+	query := r.URL.Query()
+	q := LogQuery{
+		Level: query.Get("level"),
+		Proxy: query.Get("proxy"),
+		Text:  query.Get("q"),
+		Limit: 200,
+	}
+	if _, ok := eventRanks[q.Level]; q.Level != "" && !ok {
+		jsonError(w, 400, "level must be one of trace, debug, info, warn, error")
+		return
+	}
+	if v := query.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			jsonError(w, 400, "invalid regex: "+err.Error())
+			return
+		}
+		q.Regex = re
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				jsonError(w, 400, p.name+" must be an RFC 3339 time")
+				return
+			}
+			*p.t = t
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		c, err := DecodeLogCursor(v)
+		if err != nil {
+			jsonError(w, 400, err.Error())
+			return
+		}
+		q.Cursor = c
+	}
+	if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 && v <= 1000 {
+		q.Limit = v
+	}
+
+	page, err := h.process.SearchLogs(id, q)
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+	text := make([]string, len(page.Lines))
+	for i, l := range page.Lines {
+		text[i] = l.Text
+	}
+	jsonResponse(w, 200, map[string]interface{}{
+		"logs":       strings.Join(text, "\n"),
+		"lines":      page.Lines,
+		"nextCursor": page.NextCursor,
+	})
+}
+
+// StreamLogs follows a server's output as Server-Sent Events. Recent lines
+// are sent first; a reconnecting client resumes after its Last-Event-ID.
+func (h *Handler) StreamLogs(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := h.config.GetServer(id); err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, 500, "streaming not supported")
+		return
+	}
+	n := 200
+	if v, err := strconv.Atoi(r.URL.Query().Get("lines")); err == nil && v >= 0 && v <= logHistorySize {
+		n = v
+	}
+
+	sub := h.process.SubscribeLogs(id, r.Header.Get("Last-Event-ID"), n)
+	defer sub.Cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep reverse proxies from buffering
+	w.WriteHeader(200)
+	if !sub.Resumed {
+		// Clients drop what they have; the history below replaces it
+		fmt.Fprint(w, "event: reset\ndata:\n\n")
+	}
+	for _, line := range sub.History {
+		writeLogEvent(w, line)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-sub.Lines:
+			if !ok {
+				return
+			}
+			writeLogEvent(w, line)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// ServerEvents returns parsed frpc events. Filters: level (minimum),
+// category, proxy, after (event ID) and limit.
+func (h *Handler) ServerEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := h.config.GetServer(id); err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	q := EventQuery{
+		Level:    query.Get("level"),
+		Category: query.Get("category"),
+		Proxy:    query.Get("proxy"),
+		Limit:    100,
+	}
+	if _, ok := eventRanks[q.Level]; q.Level != "" && !ok {
+		jsonError(w, 400, "level must be one of trace, debug, info, warn, error")
+		return
+	}
+	if v := query.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			jsonError(w, 400, "invalid after")
+			return
+		}
+		q.After = after
+	}
+	if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 && v <= eventHistorySize {
+		q.Limit = v
+	}
+	jsonResponse(w, 200, map[string]interface{}{"events": h.process.Events(id, q)})
+}
+
+func writeLogEvent(w io.Writer, line LogLine) {
+	fmt.Fprintf(w, "id: %s\ndata: %s\n\n", line.ID, line.Text)
+}
+
+// --- History ---
+
+func (h *Handler) ListHistory(w http.ResponseWriter, r *http.Request) {
+	list, err := h.history.List()
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, 200, list)
+}
+
+// snapshotServers resolves a snapshot ID, or "current" for the live config
+func (h *Handler) snapshotServers(ref string) ([]ServerConfig, error) {
+	if ref == "" || ref == "current" {
+		return h.config.Load()
+	}
+	_, sealed, err := h.history.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	return h.config.Unseal(sealed)
+}
+
+func (h *Handler) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	sid := r.PathValue("sid")
+	snap, sealed, err := h.history.Get(sid)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	servers, err := h.config.Unseal(sealed)
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+
+	views := make([]ServerView, len(servers))
+	for i, s := range servers {
+		views[i] = newServerView(s)
+	}
+	jsonResponse(w, 200, map[string]interface{}{
+		"snapshot": snap,
+		"servers":  views,
+	})
+}
+
+// DiffHistory compares two snapshots (or a snapshot and "current") both as
+// field-level JSON changes and as generated frpc config per server
+func (h *Handler) DiffHistory(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" {
+		jsonError(w, 400, "from is required")
+		return
+	}
+
+	a, err := h.snapshotServers(from)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	b, err := h.snapshotServers(to)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	if to == "" {
+		to = "current"
+	}
+
+	type tomlDiff struct {
+		ServerID string `json:"serverId"`
+		Name     string `json:"name"`
+		Diff     string `json:"diff"`
+	}
+	tomlA := h.maskedTomls(a)
+	tomlB := h.maskedTomls(b)
+	diffs := []tomlDiff{}
+	seen := make(map[string]bool)
+	for _, list := range [][]ServerConfig{a, b} {
+		for _, s := range list {
+			if seen[s.ID] {
+				continue
+			}
+			seen[s.ID] = true
+			if d := unifiedDiff(tomlA[s.ID], tomlB[s.ID], from+"/"+s.Name+".toml", to+"/"+s.Name+".toml"); d != "" {
+				diffs = append(diffs, tomlDiff{ServerID: s.ID, Name: s.Name, Diff: d})
+			}
+		}
+	}
+
+	jsonResponse(w, 200, map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"summary": summarizeChanges(a, b),
+		"changes": diffServers(a, b),
+		"toml":    diffs,
+	})
+}
+
+// maskedTomls generates the frpc config of each server with the token and
+// secret variables hidden
+func (h *Handler) maskedTomls(servers []ServerConfig) map[string]string {
+	out := make(map[string]string, len(servers))
+	for _, s := range servers {
+		rendered, _, err := h.config.RenderMasked(&s, h.config.expandEnvs)
+		if err != nil {
+			rendered = &s
+			rendered.AuthToken = "******"
+		}
+		out[s.ID] = formatToml(rendered)
+	}
+	return out
+}
+
+// RollbackHistory restores a snapshot. With ?restart=true, running servers
+// whose generated config changed are restarted and removed ones stopped.
+func (h *Handler) RollbackHistory(w http.ResponseWriter, r *http.Request) {
+	sid := r.PathValue("sid")
+	target, err := h.snapshotServers(sid)
+	if err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	var before []ServerConfig
+	err = h.config.UpdateAs(requestActor(r), "rollback to snapshot "+sid, func(st *State) error {
+		before = cloneServers(st.Servers)
+		st.Servers = cloneServers(target)
+		return nil
+	})
 	if err != nil {
 		jsonError(w, 500, err.Error())
 		return
 	}
-	jsonResponse(w, 200, map[string]string{"logs": logs})
+
+	report := &RestartReport{Restarted: []string{}, Stopped: []string{}, Errors: []string{}}
+	if r.URL.Query().Get("restart") == "true" {
+		report = h.applier.RestartChanged(before, target)
+	}
+	jsonResponse(w, 200, map[string]interface{}{
+		"status":    "rolled back",
+		"restarted": report.Restarted,
+		"stopped":   report.Stopped,
+		"errors":    report.Errors,
+	})
+}
+
+// ConfigWatch reports whether external edits are watched and how the last
+// one was handled
+func (h *Handler) ConfigWatch(w http.ResponseWriter, r *http.Request) {
+	if h.watcher == nil {
+		jsonResponse(w, 200, map[string]interface{}{"enabled": false})
+		return
+	}
+	jsonResponse(w, 200, map[string]interface{}{
+		"enabled":  true,
+		"interval": h.watcher.interval.Seconds(),
+		"last":     h.watcher.Last(),
+	})
+}
+
+// --- Variables ---
+
+// VariableView hides the value of secret variables
+type VariableView struct {
+	Variable
+	ValueStatus string `json:"valueStatus,omitempty"`
+}
+
+func (h *Handler) ListVariables(w http.ResponseWriter, r *http.Request) {
+	vars, err := h.vars.List()
+	if err != nil {
+		jsonError(w, 500, err.Error())
+		return
+	}
+
+	result := make([]VariableView, len(vars))
+	for i, v := range vars {
+		result[i] = VariableView{Variable: v}
+		if v.Secret {
+			result[i].Value = ""
+			result[i].ValueStatus = secretStatus(v.Value)
+		}
+	}
+	jsonResponse(w, 200, result)
+}
+
+func (h *Handler) SetVariable(w http.ResponseWriter, r *http.Request) {
+	var v Variable
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		jsonError(w, 400, "invalid request body")
+		return
+	}
+	v.Name = r.PathValue("name")
+
+	if err := h.vars.Set(v); err != nil {
+		jsonError(w, 400, err.Error())
+		return
+	}
+	// Variables feed into generated config
+	h.applier.Schedule()
+	jsonResponse(w, 200, map[string]string{"status": "saved"})
+}
+
+func (h *Handler) DeleteVariable(w http.ResponseWriter, r *http.Request) {
+	if err := h.vars.Delete(r.PathValue("name")); err != nil {
+		jsonError(w, 404, err.Error())
+		return
+	}
+	h.applier.Schedule()
+	jsonResponse(w, 200, map[string]string{"status": "deleted"})
+}
+
+// --- Docker ---
+
+func (h *Handler) dockerEnabled(w http.ResponseWriter) bool {
+	if h.docker == nil {
+		jsonError(w, 404, "docker integration is disabled (set DOCKER_DISCOVERY=true)")
+		return false
+	}
+	return true
+}
+
+func (h *Handler) DockerContainers(w http.ResponseWriter, r *http.Request) {
+	if !h.dockerEnabled(w) {
+		return
+	}
+	containers, err := h.docker.Containers()
+	if err != nil {
+		jsonError(w, 502, err.Error())
+		return
+	}
+	jsonResponse(w, 200, containers)
+}
+
+func (h *Handler) DockerSuggestions(w http.ResponseWriter, r *http.Request) {
+	if !h.dockerEnabled(w) {
+		return
+	}
+	suggestions, err := h.docker.Suggestions()
+	if err != nil {
+		jsonError(w, 502, err.Error())
+		return
+	}
+	jsonResponse(w, 200, suggestions)
+}
+
+func (h *Handler) DockerReconcile(w http.ResponseWriter, r *http.Request) {
+	if !h.dockerEnabled(w) {
+		return
+	}
+	report, err := h.docker.Reconcile()
+	if err != nil {
+		jsonError(w, 502, err.Error())
+		return
+	}
+	jsonResponse(w, 200, report)
 }
 
 // --- FRPC Version ---
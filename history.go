@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot describes one saved configuration state
+type Snapshot struct {
+	ID      string   `json:"id"`
+	Time    string   `json:"time"`
+	Actor   string   `json:"actor"`
+	Summary []string `json:"summary"`
+}
+
+type snapshotFile struct {
+	Snapshot
+	Servers json.RawMessage `json:"servers"`
+}
+
+// queuedSnapshot is a snapshot that has not been written yet
+type queuedSnapshot struct {
+	Snapshot
+	servers []ServerConfig // sealed; never modified once committed
+}
+
+// HistoryManager keeps a bounded list of servers.json snapshots in
+// DATA_DIR/history. Snapshots hold the file as written, so secrets stay
+// encrypted. They are written in the background, so that saving a change
+// does not wait for a copy of the whole config to reach the disk.
+type HistoryManager struct {
+	dir      string
+	limit    int
+	seq      int
+	ids      []string // oldest first, including queued snapshots
+	queue    []*queuedSnapshot
+	draining bool
+	written  *sync.Cond // signalled whenever the queue shrinks
+	mu       sync.Mutex
+}
+
+func NewHistoryManager(dataDir string, limit int) *HistoryManager {
+	dir := filepath.Join(dataDir, "history")
+	os.MkdirAll(dir, 0700)
+
+	hm := &HistoryManager{dir: dir, limit: limit}
+	hm.written = sync.NewCond(&hm.mu)
+	hm.ids = listSnapshots(dir)
+	for _, id := range hm.ids {
+		if n, err := strconv.Atoi(id); err == nil && n > hm.seq {
+			hm.seq = n
+		}
+	}
+	return hm
+}
+
+// listSnapshots returns the IDs of the snapshots in dir, oldest first
+func listSnapshots(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var ids []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (hm *HistoryManager) path(id string) string {
+	return filepath.Join(hm.dir, id+".json")
+}
+
+// Empty reports whether no snapshot has been recorded yet
+func (hm *HistoryManager) Empty() bool {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	return len(hm.ids) == 0
+}
+
+// Record queues a snapshot of the sealed servers for writing. Snapshots
+// are written in order and the oldest beyond the limit are pruned.
+func (hm *HistoryManager) Record(actor string, summary []string, sealed []ServerConfig) *Snapshot {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	hm.seq++
+	snap := &queuedSnapshot{
+		Snapshot: Snapshot{
+			ID:      fmt.Sprintf("%08d", hm.seq),
+			Time:    time.Now().Format(time.RFC3339),
+			Actor:   actor,
+			Summary: summary,
+		},
+		servers: sealed,
+	}
+	if snap.Summary == nil {
+		snap.Summary = []string{}
+	}
+	hm.ids = append(hm.ids, snap.ID)
+	hm.queue = append(hm.queue, snap)
+	if !hm.draining {
+		hm.draining = true
+		go hm.drain()
+	}
+	return &snap.Snapshot
+}
+
+// drain writes queued snapshots until none are left
+func (hm *HistoryManager) drain() {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	for len(hm.queue) > 0 {
+		snap := hm.queue[0]
+		hm.mu.Unlock()
+		err := hm.write(snap)
+		hm.mu.Lock()
+		if err != nil {
+			log.Printf("Failed to record config history: %v", err)
+		}
+		hm.queue = hm.queue[1:]
+		hm.prune()
+		hm.written.Broadcast()
+	}
+	hm.draining = false
+}
+
+func (hm *HistoryManager) write(snap *queuedSnapshot) error {
+	servers, err := json.MarshalIndent(snap.servers, "", "  ")
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(snapshotFile{Snapshot: snap.Snapshot, Servers: servers}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(hm.path(snap.ID), b, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+// prune drops the oldest snapshots beyond the limit. hm.mu must be held
+// and no snapshot may be being written.
+func (hm *HistoryManager) prune() {
+	for len(hm.ids) > hm.limit {
+		id := hm.ids[0]
+		hm.ids = hm.ids[1:]
+		if q := hm.queued(id); q >= 0 {
+			hm.queue = append(hm.queue[:q], hm.queue[q+1:]...)
+			continue
+		}
+		os.Remove(hm.path(id))
+	}
+}
+
+// queued returns the position of a snapshot in the queue, or -1.
+// hm.mu must be held.
+func (hm *HistoryManager) queued(id string) int {
+	for i, q := range hm.queue {
+		if q.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Flush waits until all recorded snapshots have been written
+func (hm *HistoryManager) Flush() {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	for len(hm.queue) > 0 {
+		hm.written.Wait()
+	}
+}
+
+// List returns snapshot metadata, newest first
+func (hm *HistoryManager) List() ([]Snapshot, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	ids := hm.ids
+	list := make([]Snapshot, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		snap, err := hm.read(ids[i])
+		if err != nil {
+			continue
+		}
+		list = append(list, snap.Snapshot)
+	}
+	return list, nil
+}
+
+// Get returns a snapshot and its sealed servers.json content
+func (hm *HistoryManager) Get(id string) (*Snapshot, []byte, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	snap, err := hm.read(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &snap.Snapshot, snap.Servers, nil
+}
+
+// read returns a snapshot from the queue or its file. hm.mu must be held.
+func (hm *HistoryManager) read(id string) (*snapshotFile, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		return nil, fmt.Errorf("snapshot not found: %s", id)
+	}
+	if q := hm.queued(id); q >= 0 {
+		servers, err := json.MarshalIndent(hm.queue[q].servers, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return &snapshotFile{Snapshot: hm.queue[q].Snapshot, Servers: servers}, nil
+	}
+	b, err := os.ReadFile(hm.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("snapshot not found: %s", id)
+		}
+		return nil, err
+	}
+	var snap snapshotFile
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s is corrupt: %v", id, err)
+	}
+	return &snap, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestHistoryRecordAndPrune(t *testing.T) {
+	dir := t.TempDir()
+	hm := NewHistoryManager(dir, 10)
+	for i := 1; i <= 15; i++ {
+		hm.Record("test", []string{fmt.Sprintf("change %d", i)}, []ServerConfig{{ID: "s", ServerPort: i}})
+		// Queued snapshots are readable before they are written
+		if _, _, err := hm.Get(fmt.Sprintf("%08d", i)); err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+	}
+	hm.Flush()
+
+	// A new manager sees only what reached the disk
+	hm = NewHistoryManager(dir, 10)
+	list, err := hm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 10 || list[0].ID != "00000015" || list[9].ID != "00000006" {
+		t.Fatalf("unexpected snapshots %+v", list)
+	}
+	if _, _, err := hm.Get("00000005"); err == nil {
+		t.Fatal("pruned snapshot 5 is still there")
+	}
+	_, b, err := hm.Get("00000015")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []ServerConfig
+	if err := json.Unmarshal(b, &servers); err != nil || len(servers) != 1 || servers[0].ServerPort != 15 {
+		t.Fatalf("snapshot 15 holds %s (%v)", b, err)
+	}
+
+	// Numbering continues after a restart
+	if snap := hm.Record("test", nil, nil); snap.ID != "00000016" {
+		t.Fatalf("got snapshot %s, want 00000016", snap.ID)
+	}
+	hm.Flush()
+}
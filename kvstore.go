@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kvCompactMinSize is the log size below which the log is never compacted
+const kvCompactMinSize = 1 << 20
+
+const (
+	kvServerPrefix = "servers/"
+	kvProxyPrefix  = "proxies/" // proxies/<server ID>/<proxy ID>
+	kvOrderKey     = "order"
+)
+
+// kvServer is a server record; its proxies are stored as separate records
+type kvServer struct {
+	ServerConfig
+	ProxyIDs []string `json:"proxyIds"`
+}
+
+// kvBatch is one transaction in the log
+type kvBatch struct {
+	Put map[string]json.RawMessage `json:"put,omitempty"`
+	Del []string                   `json:"del,omitempty"`
+}
+
+// KVStorage is an append-only key-value log with one record per server and
+// per proxy. A save appends a single checksummed batch holding only the
+// records that changed, so toggling one proxy writes a few hundred bytes
+// instead of the whole configuration. A torn batch at the end of the log,
+// left by a crash mid-write, is discarded on open.
+//
+// Each batch is framed as a 4-byte big-endian length, a 4-byte CRC-32 of
+// the payload and the JSON-encoded kvBatch.
+type KVStorage struct {
+	path string
+	f    *os.File
+	data map[string][]byte
+	size int64 // bytes of valid log
+	mu   sync.Mutex
+}
+
+// OpenKVStorage opens or creates the log at path and replays it
+func OpenKVStorage(path string) (*KVStorage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ks := &KVStorage{path: path, f: f, data: make(map[string][]byte)}
+	if err := ks.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *KVStorage) replay() error {
+	raw, err := io.ReadAll(ks.f)
+	if err != nil {
+		return err
+	}
+
+	var off int64
+	for int64(len(raw))-off >= 8 {
+		n := int64(binary.BigEndian.Uint32(raw[off:]))
+		sum := binary.BigEndian.Uint32(raw[off+4:])
+		end := off + 8 + n
+		if end > int64(len(raw)) || crc32.ChecksumIEEE(raw[off+8:end]) != sum {
+			break
+		}
+		var batch kvBatch
+		if err := json.Unmarshal(raw[off+8:end], &batch); err != nil {
+			break
+		}
+		ks.apply(&batch)
+		off = end
+	}
+
+	if off < int64(len(raw)) {
+		log.Printf("Discarding %d bytes of incomplete writes at the end of %s", int64(len(raw))-off, ks.path)
+		if err := ks.f.Truncate(off); err != nil {
+			return err
+		}
+	}
+	ks.size = off
+	return nil
+}
+
+func (ks *KVStorage) apply(batch *kvBatch) {
+	for k, v := range batch.Put {
+		ks.data[k] = v
+	}
+	for _, k := range batch.Del {
+		delete(ks.data, k)
+	}
+}
+
+func (ks *KVStorage) Load() ([]ServerConfig, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var order []string
+	if b, ok := ks.data[kvOrderKey]; ok {
+		if err := json.Unmarshal(b, &order); err != nil {
+			return nil, fmt.Errorf("%s: corrupt server order: %v", ks.path, err)
+		}
+	}
+	// Records missing from the order list are kept, after the ordered ones
+	listed := make(map[string]bool, len(order))
+	for _, id := range order {
+		listed[id] = true
+	}
+	var extra []string
+	for k := range ks.data {
+		if id, ok := strings.CutPrefix(k, kvServerPrefix); ok && !listed[id] {
+			extra = append(extra, id)
+		}
+	}
+	sort.Strings(extra)
+
+	servers := []ServerConfig{}
+	for _, id := range append(order, extra...) {
+		b, ok := ks.data[kvServerPrefix+id]
+		if !ok {
+			continue
+		}
+		var rec kvServer
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("%s: corrupt record for server %s: %v", ks.path, id, err)
+		}
+		s := rec.ServerConfig
+		s.Proxies = []ProxyConfig{}
+		for _, pid := range rec.ProxyIDs {
+			pb, ok := ks.data[kvProxyPrefix+id+"/"+pid]
+			if !ok {
+				return nil, fmt.Errorf("%s: server %s is missing proxy %s", ks.path, id, pid)
+			}
+			var p ProxyConfig
+			if err := json.Unmarshal(pb, &p); err != nil {
+				return nil, fmt.Errorf("%s: corrupt record for proxy %s: %v", ks.path, pid, err)
+			}
+			s.Proxies = append(s.Proxies, p)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+func (ks *KVStorage) Save(servers []ServerConfig) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	batch := kvBatch{Put: make(map[string]json.RawMessage)}
+	order := make([]string, len(servers))
+	keep := make(map[string]bool)
+	put := func(key string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		keep[key] = true
+		if !bytes.Equal(ks.data[key], b) {
+			batch.Put[key] = b
+		}
+		return nil
+	}
+	for i, s := range servers {
+		order[i] = s.ID
+		rec := kvServer{ServerConfig: s, ProxyIDs: make([]string, len(s.Proxies))}
+		rec.Proxies = nil
+		for j, p := range s.Proxies {
+			rec.ProxyIDs[j] = p.ID
+			if err := put(kvProxyPrefix+s.ID+"/"+p.ID, p); err != nil {
+				return err
+			}
+		}
+		if err := put(kvServerPrefix+s.ID, rec); err != nil {
+			return err
+		}
+	}
+	for k := range ks.data {
+		if k != kvOrderKey && !keep[k] {
+			batch.Del = append(batch.Del, k)
+		}
+	}
+	sort.Strings(batch.Del)
+	ob, _ := json.Marshal(order)
+	if !bytes.Equal(ks.data[kvOrderKey], ob) {
+		batch.Put[kvOrderKey] = ob
+	}
+	if len(batch.Put) == 0 && len(batch.Del) == 0 {
+		return nil
+	}
+
+	frame, err := kvFrame(&batch)
+	if err != nil {
+		return err
+	}
+	// Write at the known end so a failed write can be cut off again
+	if _, err := ks.f.WriteAt(frame, ks.size); err != nil {
+		ks.f.Truncate(ks.size)
+		return err
+	}
+	if err := ks.f.Sync(); err != nil {
+		ks.f.Truncate(ks.size)
+		return err
+	}
+	ks.size += int64(len(frame))
+	ks.apply(&batch)
+
+	if ks.size > kvCompactMinSize && ks.size > 4*ks.liveSize() {
+		if err := ks.compact(); err != nil {
+			log.Printf("Failed to compact %s: %v", ks.path, err)
+		}
+	}
+	return nil
+}
+
+func (ks *KVStorage) liveSize() int64 {
+	var n int64
+	for k, v := range ks.data {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// compact rewrites the log as a single batch holding the live records
+func (ks *KVStorage) compact() error {
+	batch := kvBatch{Put: make(map[string]json.RawMessage, len(ks.data))}
+	for k, v := range ks.data {
+		batch.Put[k] = v
+	}
+	frame, err := kvFrame(&batch)
+	if err != nil {
+		return err
+	}
+
+	// Windows cannot rename over an open file
+	ks.f.Close()
+	writeErr := writeFileAtomic(ks.path, frame, 0600)
+	f, err := os.OpenFile(ks.path, os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen %s: %v", ks.path, err)
+	}
+	ks.f = f
+	if writeErr != nil {
+		return writeErr
+	}
+	ks.size = int64(len(frame))
+	return nil
+}
+
+func kvFrame(batch *kvBatch) ([]byte, error) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	copy(frame[8:], payload)
+	return frame, nil
+}
+
+func (ks *KVStorage) Close() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.f.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVStorageReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servers.kv")
+
+	// Three saves; sizes[i] is the log size after save i
+	saves := [][]ServerConfig{
+		{{ID: "s1", Name: "home", ServerPort: 7000, Proxies: []ProxyConfig{{ID: "p1", Name: "web"}, {ID: "p2", Name: "ssh"}}}},
+		{{ID: "s1", Name: "home", ServerPort: 7001, Proxies: []ProxyConfig{{ID: "p1", Name: "web"}, {ID: "p2", Name: "ssh"}}}, {ID: "s2", Name: "office"}},
+		{{ID: "s2", Name: "office"}, {ID: "s1", Name: "home", ServerPort: 7001, Proxies: []ProxyConfig{{ID: "p2", Name: "ssh"}}}},
+	}
+	ks, err := OpenKVStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, servers := range saves {
+		if err := ks.Save(servers); err != nil {
+			t.Fatal(err)
+		}
+		st, _ := os.Stat(path)
+		sizes = append(sizes, st.Size())
+	}
+	// Saving unchanged servers appends nothing
+	if err := ks.Save(saves[2]); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := os.Stat(path); st.Size() != sizes[2] {
+		t.Fatalf("unchanged save grew the log from %d to %d bytes", sizes[2], st.Size())
+	}
+	ks.Close()
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damage returns a modified copy of the log
+	damage := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte(nil), log...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want int // saves that survive
+	}{
+		{"intact", log, 3},
+		{"torn payload", log[:sizes[2]-5], 2},
+		{"torn header", log[:sizes[1]+6], 2},
+		{"trailing garbage", damage(func(b []byte) []byte { return append(b, 0xde, 0xad) }), 3},
+		{"bad checksum", damage(func(b []byte) []byte { b[sizes[1]+10] ^= 0xff; return b }), 2},
+		{"oversized length", damage(func(b []byte) []byte { binary.BigEndian.PutUint32(b[sizes[0]:], 1<<30); return b }), 1},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		ks, err := OpenKVStorage(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		servers, err := ks.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := []ServerConfig{}
+		size := int64(0)
+		if tt.want > 0 {
+			want = saves[tt.want-1]
+			size = sizes[tt.want-1]
+		}
+		if !sameServers(servers, want) {
+			t.Errorf("%s: loaded %+v, want %+v", tt.name, servers, want)
+		}
+		if st, _ := os.Stat(path); st.Size() != size {
+			t.Errorf("%s: log is %d bytes after open, want %d", tt.name, st.Size(), size)
+		}
+
+		// The log can be appended to once the tail is cut off
+		if err := ks.Save(saves[0]); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ks.Close()
+		ks, err = OpenKVStorage(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if servers, _ := ks.Load(); !sameServers(servers, saves[0]) {
+			t.Errorf("%s: after a new save loaded %+v", tt.name, servers)
+		}
+		ks.Close()
+	}
+}
+
+// sameServers compares the IDs, ports and proxy IDs of two server lists
+func sameServers(a, b []ServerConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].ServerPort != b[i].ServerPort || len(a[i].Proxies) != len(b[i].Proxies) {
+			return false
+		}
+		for j := range a[i].Proxies {
+			if a[i].Proxies[j].ID != b[i].Proxies[j].ID {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logHistorySize is how many recent lines per server are kept in memory for
+// new and reconnecting viewers
+const logHistorySize = 1000
+
+// LogLine is one line of frpc output. IDs are "<epoch>-<seq>"; the epoch
+// changes whenever the GUI restarts, so stale IDs from a reconnecting
+// client are recognized.
+type LogLine struct {
+	ID       string
+	Text     string
+	seq      int64
+	replayed bool // read back from the log file rather than live output
+}
+
+// LogHub fans frpc output out to any number of viewers. Lines are kept in a
+// per-server ring so viewers never read the log files themselves.
+type LogHub struct {
+	epoch    string
+	seed     func(serverID string) []string // existing lines for a new channel
+	channels map[string]*logChannel
+	// observers see every line, including those loaded from the log file;
+	// they are called with mu held and must not use the hub
+	observers []func(serverID string, line LogLine)
+	closed    bool
+	mu        sync.Mutex
+}
+
+type logChannel struct {
+	seq   int64
+	lines []LogLine // oldest first
+	subs  map[chan LogLine]bool
+}
+
+func NewLogHub(seed func(serverID string) []string) *LogHub {
+	return &LogHub{
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		seed:     seed,
+		channels: make(map[string]*logChannel),
+	}
+}
+
+// channel returns the channel of a server, filling a new one with the end
+// of its log file. hub.mu must be held.
+func (hub *LogHub) channel(serverID string) *logChannel {
+	c, ok := hub.channels[serverID]
+	if ok {
+		return c
+	}
+	c = &logChannel{subs: make(map[chan LogLine]bool)}
+	hub.channels[serverID] = c
+	if hub.seed != nil {
+		for _, text := range hub.seed(serverID) {
+			hub.append(serverID, c, text, true)
+		}
+	}
+	return c
+}
+
+// append adds a line to c. hub.mu must be held.
+func (hub *LogHub) append(serverID string, c *logChannel, text string, replayed bool) LogLine {
+	c.seq++
+	line := LogLine{ID: fmt.Sprintf("%s-%d", hub.epoch, c.seq), Text: text, seq: c.seq, replayed: replayed}
+	c.lines = append(c.lines, line)
+	if len(c.lines) > 2*logHistorySize {
+		c.lines = append([]LogLine(nil), c.lines[len(c.lines)-logHistorySize:]...)
+	}
+	for _, fn := range hub.observers {
+		fn(serverID, line)
+	}
+	return line
+}
+
+// Observe registers fn to be called for every line
+func (hub *LogHub) Observe(fn func(serverID string, line LogLine)) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.observers = append(hub.observers, fn)
+}
+
+// Publish adds a line and sends it to the server's viewers. Viewers that
+// fall behind are dropped; they reconnect and catch up from the history.
+func (hub *LogHub) Publish(serverID, text string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	c := hub.channel(serverID)
+	line := hub.append(serverID, c, text, false)
+	for ch := range c.subs {
+		select {
+		case ch <- line:
+		default:
+			delete(c.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// LogSubscription is one viewer of a server's output. Lines is closed if
+// the viewer falls behind or the hub is closed; Cancel must be called when
+// the viewer goes away.
+type LogSubscription struct {
+	History []LogLine
+	Lines   <-chan LogLine
+	Resumed bool // History continues from the viewer's last event
+	Cancel  func()
+}
+
+// Subscribe returns the lines after lastEventID, or the last n lines when
+// lastEventID is empty or stale, and follows new lines
+func (hub *LogHub) Subscribe(serverID, lastEventID string, n int) *LogSubscription {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan LogLine, 256)
+	if hub.closed {
+		close(ch)
+		return &LogSubscription{Lines: ch, Cancel: func() {}}
+	}
+	c := hub.channel(serverID)
+	history := c.lines
+	if len(history) > logHistorySize {
+		history = history[len(history)-logHistorySize:]
+	}
+
+	after := int64(-1)
+	if epoch, seq, ok := strings.Cut(lastEventID, "-"); ok && epoch == hub.epoch {
+		if v, err := strconv.ParseInt(seq, 10, 64); err == nil && v <= c.seq {
+			after = v
+		}
+	}
+	if after >= 0 {
+		i := 0
+		for i < len(history) && history[i].seq <= after {
+			i++
+		}
+		history = history[i:]
+	} else if len(history) > n {
+		history = history[len(history)-n:]
+	}
+	history = append([]LogLine(nil), history...)
+
+	c.subs[ch] = true
+	cancel := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		if c.subs[ch] {
+			delete(c.subs, ch)
+			close(ch)
+		}
+	}
+	return &LogSubscription{History: history, Lines: ch, Resumed: after >= 0, Cancel: cancel}
+}
+
+// Close ends all streams, e.g. so HTTP shutdown does not wait for them
+func (hub *LogHub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for _, c := range hub.channels {
+		for ch := range c.subs {
+			close(ch)
+		}
+		c.subs = make(map[chan LogLine]bool)
+	}
+}
+
+// Load makes sure the lines of a server's log file have been read
+func (hub *LogHub) Load(serverID string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.channel(serverID)
+}
+
+// Writer returns a writer that publishes each complete line written to it
+func (hub *LogHub) Writer(serverID string) io.Writer {
+	hub.Load(serverID)
+	return &lineWriter{hub: hub, serverID: serverID}
+}
+
+// lineWriter splits output into lines for the hub
+type lineWriter struct {
+	hub      *LogHub
+	serverID string
+	partial  []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.partial = append(lw.partial, p...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lw.hub.Publish(lw.serverID, strings.TrimRight(string(lw.partial[:i]), "\r"))
+		lw.partial = lw.partial[i+1:]
+	}
+	// A line without end is published in pieces rather than held forever
+	if len(lw.partial) > 64<<10 {
+		lw.hub.Publish(lw.serverID, string(lw.partial))
+		lw.partial = nil
+	}
+	return len(p), nil
+}
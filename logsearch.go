@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogQuery selects lines of a server's log. Zero values match everything.
+type LogQuery struct {
+	Level  string // minimum level
+	Proxy  string
+	Text   string         // case-insensitive substring
+	Regex  *regexp.Regexp // RE2 syntax
+	Since  time.Time
+	Until  time.Time
+	Cursor *LogCursor // continue with lines older than this
+	Limit  int
+}
+
+// LogEntry is one matching line
+type LogEntry struct {
+	Time  string `json:"time,omitempty"` // of the line or the last timestamp before it
+	Level string `json:"level"`
+	Proxy string `json:"proxy,omitempty"`
+	Text  string `json:"text"`
+}
+
+// LogPage is a page of matching lines, oldest first. NextCursor fetches
+// the page before it and is empty once the oldest segment is reached.
+type LogPage struct {
+	Lines      []LogEntry `json:"lines"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// LogCursor is the position a page stopped at. Segments are named by base
+// name without .gz, since they may be compressed between two requests.
+// The current log has no name; Newest is the newest segment at the time,
+// so that the position is found again after the log has been rotated.
+type LogCursor struct {
+	File   string `json:"f,omitempty"`
+	Newest string `json:"n,omitempty"`
+	Offset int64  `json:"o"` // lines starting at or after this are done; -1 for none
+}
+
+func (c *LogCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeLogCursor(s string) (*LogCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	var c LogCursor
+	if err != nil || json.Unmarshal(b, &c) != nil || strings.ContainsAny(c.File, `/\`) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// logFile is a log or rotated segment in search order
+type logFile struct {
+	path string
+	name string // base name without .gz; empty for the current log
+}
+
+// SearchLogs pages backwards through a server's log and its rotated
+// segments. Files are streamed and only one page of matches is held in
+// memory, so compressed segments can be searched as well.
+func (pm *ProcessManager) SearchLogs(serverID string, q LogQuery) (*LogPage, error) {
+	logPath := pm.logPath(serverID)
+	files := []logFile{{path: logPath}}
+	for _, s := range logSegments(logPath) {
+		files = append(files, logFile{path: s, name: strings.TrimSuffix(filepath.Base(s), ".gz")})
+	}
+	// Newest first
+	for i, j := 1, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+	newest := ""
+	if len(files) > 1 {
+		newest = files[1].name
+	}
+
+	start, end := 0, int64(-1)
+	if c := q.Cursor; c != nil {
+		start = -1
+		for i, f := range files {
+			// The log the cursor was in is now the first segment after Newest
+			if (c.File == "" && ((i == 0 && c.Newest == newest) || (i > 0 && f.name > c.Newest))) || (c.File != "" && f.name == c.File) {
+				start = i
+			}
+			if c.File == "" && i > 0 && f.name <= c.Newest {
+				break
+			}
+		}
+		if start < 0 {
+			return &LogPage{Lines: []LogEntry{}}, nil // segment has been pruned
+		}
+		end = c.Offset
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 200
+	}
+	page := &LogPage{}
+	for i := start; i < len(files) && len(page.Lines) < limit; i++ {
+		f := files[i]
+		if i != start {
+			end = -1
+		}
+
+		entries, first, more, err := searchFile(f.path, i == 0, end, q, limit-len(page.Lines))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		page.Lines = append(entries, page.Lines...)
+		cursor := &LogCursor{File: f.name, Offset: first}
+		if f.name == "" {
+			cursor.Newest = newest
+		}
+		switch {
+		case more:
+			page.NextCursor = cursor.Encode()
+		case i+1 < len(files):
+			page.NextCursor = (&LogCursor{File: files[i+1].name, Offset: -1}).Encode()
+		default:
+			page.NextCursor = ""
+		}
+		if more {
+			break
+		}
+	}
+	if page.Lines == nil {
+		page.Lines = []LogEntry{}
+	}
+	return page, nil
+}
+
+// searchFile returns the last n matches among the lines of path that start
+// before end (-1 for the whole file), the offset of the first one, and
+// whether earlier lines matched too. An unfinished last line of the
+// current log is left out.
+func searchFile(path string, current bool, end int64, q LogQuery, n int) ([]LogEntry, int64, bool, error) {
+	rc, err := openSegment(path)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer rc.Close()
+
+	type match struct {
+		entry  LogEntry
+		offset int64
+	}
+	ring := make([]match, 0, n)
+	head, dropped := 0, false
+	minRank := eventRanks[q.Level]
+	text := strings.ToLower(q.Text)
+
+	r := bufio.NewReaderSize(rc, 64<<10)
+	var offset int64
+	var last time.Time // lines without a timestamp belong to the last one
+	for end < 0 || offset < end {
+		line, err := r.ReadString('\n')
+		lineOffset := offset
+		offset += int64(len(line))
+		if err == io.EOF && (current || line == "") {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, 0, false, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		ev, ok := parseLogLine(line)
+		if !ok {
+			continue
+		}
+		if !ev.at.IsZero() {
+			last = ev.at
+		}
+		if eventRanks[ev.Level] < minRank || (q.Proxy != "" && ev.Proxy != q.Proxy) {
+			continue
+		}
+		if (!q.Since.IsZero() || !q.Until.IsZero()) && (last.IsZero() || last.Before(q.Since) || (!q.Until.IsZero() && last.After(q.Until))) {
+			continue
+		}
+		if (text != "" && !strings.Contains(strings.ToLower(line), text)) || (q.Regex != nil && !q.Regex.MatchString(line)) {
+			continue
+		}
+
+		m := match{entry: LogEntry{Level: ev.Level, Proxy: ev.Proxy, Text: line}, offset: lineOffset}
+		if !last.IsZero() {
+			m.entry.Time = last.Format(time.RFC3339)
+		}
+		if len(ring) < n {
+			ring = append(ring, m)
+		} else {
+			ring[head] = m
+			head = (head + 1) % n
+			dropped = true
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	entries := make([]LogEntry, 0, len(ring))
+	var first int64
+	for i := range ring {
+		m := ring[(head+i)%len(ring)]
+		if i == 0 {
+			first = m.offset
+		}
+		entries = append(entries, m.entry)
+	}
+	return entries, first, dropped, nil
+}
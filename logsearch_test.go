@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLogLines writes frpc-style lines numbered from..to to path,
+// gzipped when path ends in .gz
+func writeLogLines(t *testing.T, path string, from, to int, tail string) {
+	t.Helper()
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		level := "I"
+		if i%3 == 0 {
+			level = "W"
+		}
+		fmt.Fprintf(&b, "2024-01-02 15:04:%02d [%s] [client/service.go:1] line %d\n", i, level, i)
+	}
+	b.WriteString(tail)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !strings.HasSuffix(path, ".gz") {
+		f.WriteString(b.String())
+		return
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte(b.String()))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func segmentPath(log string, at time.Time) string {
+	return log + "." + at.Format(segmentTimeFormat)
+}
+
+// pageNumbers returns the line numbers of a page
+func pageNumbers(page *LogPage) []int {
+	var nums []int
+	for _, l := range page.Lines {
+		var n int
+		fmt.Sscanf(l.Text[strings.LastIndex(l.Text, " ")+1:], "%d", &n)
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+func TestSearchLogsPaging(t *testing.T) {
+	pm := NewProcessManager(t.TempDir())
+	log := pm.logPath("s")
+	t0 := time.Date(2024, 1, 2, 15, 0, 0, 0, time.Local)
+	writeLogLines(t, segmentPath(log, t0)+".gz", 1, 3, "")
+	writeLogLines(t, segmentPath(log, t0.Add(time.Minute)), 4, 6, "")
+	writeLogLines(t, log, 7, 9, "2024-01-02 15:04:10 [I] unfinished")
+
+	search := func(q LogQuery) *LogPage {
+		t.Helper()
+		page, err := pm.SearchLogs("s", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	// collect pages through all files, newest page first
+	collect := func(q LogQuery) []string {
+		t.Helper()
+		var pages []string
+		for i := 0; i < 20; i++ {
+			page := search(q)
+			pages = append(pages, fmt.Sprint(pageNumbers(page)))
+			if page.NextCursor == "" {
+				return pages
+			}
+			c, err := DecodeLogCursor(page.NextCursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Cursor = c
+		}
+		t.Fatal("paging does not end")
+		return nil
+	}
+
+	tests := []struct {
+		name string
+		q    LogQuery
+		want string
+	}{
+		{"all", LogQuery{}, "[[1 2 3 4 5 6 7 8 9]]"},
+		{"pages of two", LogQuery{Limit: 2}, "[[8 9] [6 7] [4 5] [2 3] [1]]"},
+		{"pages of four", LogQuery{Limit: 4}, "[[6 7 8 9] [2 3 4 5] [1]]"},
+		{"level", LogQuery{Level: "warn", Limit: 2}, "[[6 9] [3]]"},
+		{"text", LogQuery{Text: "LINE 5"}, "[[5]]"},
+		{"time range", LogQuery{Since: t0.Add(4*time.Minute + 4*time.Second), Until: t0.Add(4*time.Minute + 7*time.Second)}, "[[4 5 6 7]]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(collect(tt.q)); got != tt.want {
+			t.Errorf("%s: got pages %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// A cursor into the current log still points at the same lines after
+	// the log has been rotated
+	page := search(LogQuery{Limit: 2})
+	cursor, err := DecodeLogCursor(page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(log, segmentPath(log, t0.Add(2*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	writeLogLines(t, log, 10, 11, "")
+	if got := pageNumbers(search(LogQuery{Limit: 2, Cursor: cursor})); fmt.Sprint(got) != "[6 7]" {
+		t.Fatalf("after rotation got %v, want [6 7]", got)
+	}
+
+	// Pruned segments end the search
+	cursor = &LogCursor{File: segmentPath("s.log", t0.Add(-time.Hour)), Offset: -1}
+	if page := search(LogQuery{Cursor: cursor}); len(page.Lines) != 0 || page.NextCursor != "" {
+		t.Fatalf("pruned segment gave %+v", page)
+	}
+
+	if _, err := DecodeLogCursor((&LogCursor{File: "../x"}).Encode()); err == nil {
+		t.Fatal("cursor with a path accepted")
+	}
+}
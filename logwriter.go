@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogRotation limits how much frpc output is kept per server
+type LogRotation struct {
+	MaxSize  int64         // rotate once the current log reaches this many bytes
+	MaxAge   time.Duration // delete rotated segments older than this; 0 keeps them
+	MaxFiles int           // keep at most this many rotated segments; 0 means no limit
+	Compress bool          // gzip rotated segments
+}
+
+var defaultLogRotation = LogRotation{MaxSize: 10 << 20, MaxAge: 7 * 24 * time.Hour, MaxFiles: 5}
+
+// segmentTimeFormat names rotated segments <log>.<time>[.gz], so that they
+// sort by age
+const segmentTimeFormat = "20060102-150405.000000"
+
+// logPollInterval is how often a followed log is checked for new output
+const logPollInterval = 250 * time.Millisecond
+
+// LogFollower publishes the output frpc appends to its log file and rotates
+// the file when it grows past MaxSize. frpc writes to the file itself rather
+// than through a pipe of ours, so that an adopted process keeps running when
+// the GUI goes away. Rotation therefore copies the log to a timestamped
+// segment and truncates it; frpc has the file open with O_APPEND and carries
+// on at its start.
+type LogFollower struct {
+	path   string
+	opts   LogRotation
+	out    io.Writer
+	offset int64 // of the first byte not yet published
+	stop   chan struct{}
+	done   chan struct{}
+	bg     sync.Mutex // serializes compressing and pruning
+}
+
+// FollowLog writes everything appended to path after offset to out until
+// Close is called
+func FollowLog(path string, offset int64, opts LogRotation, out io.Writer) *LogFollower {
+	lf := &LogFollower{path: path, opts: opts, out: out, offset: offset, stop: make(chan struct{}), done: make(chan struct{})}
+	// Segments also age out while a server is not logging much
+	go func() {
+		lf.bg.Lock()
+		defer lf.bg.Unlock()
+		pruneSegments(path, opts)
+	}()
+	go lf.run()
+	return lf
+}
+
+func (lf *LogFollower) run() {
+	defer close(lf.done)
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lf.stop:
+			lf.poll() // output written right before frpc exited
+			return
+		case <-ticker.C:
+			lf.poll()
+		}
+	}
+}
+
+// poll publishes new output and rotates the log if it is due
+func (lf *LogFollower) poll() {
+	f, err := os.Open(lf.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if st.Size() < lf.offset {
+		// Truncated elsewhere, e.g. rotated by a previous instance
+		lf.offset = 0
+	}
+	n, _ := io.Copy(lf.out, io.NewSectionReader(f, lf.offset, st.Size()-lf.offset))
+	lf.offset += n
+
+	if lf.opts.MaxSize > 0 && lf.offset >= lf.opts.MaxSize {
+		if err := lf.rotate(); err != nil {
+			// Keep logging to the oversized file rather than lose output
+			log.Printf("Failed to rotate %s: %v", lf.path, err)
+		}
+	}
+}
+
+// rotate copies the log to a segment and truncates it. Output written
+// between the copy and the truncation is lost.
+func (lf *LogFollower) rotate() error {
+	segment := lf.path + "." + time.Now().Format(segmentTimeFormat)
+	src, err := os.Open(lf.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(segment, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(segment)
+		return err
+	}
+
+	// Publish what was appended since the last poll before it is gone
+	if n > lf.offset {
+		io.Copy(lf.out, io.NewSectionReader(src, lf.offset, n-lf.offset))
+		lf.offset = n
+	}
+	if err := os.Truncate(lf.path, 0); err != nil {
+		return err
+	}
+	lf.offset = 0
+
+	opts := lf.opts
+	go func() {
+		lf.bg.Lock()
+		defer lf.bg.Unlock()
+		if opts.Compress {
+			if err := gzipFile(segment); err != nil {
+				log.Printf("Failed to compress %s: %v", segment, err)
+			}
+		}
+		pruneSegments(lf.path, opts)
+	}()
+	return nil
+}
+
+// Close publishes the remaining output and stops following
+func (lf *LogFollower) Close() {
+	close(lf.stop)
+	<-lf.done
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+".gz", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// logSegments returns the rotated segments of a log, oldest first
+func logSegments(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var segments []string
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if _, err := time.Parse(segmentTimeFormat, name); err == nil {
+			segments = append(segments, m)
+		}
+	}
+	sort.Strings(segments)
+	return segments
+}
+
+func pruneSegments(path string, opts LogRotation) {
+	segments := logSegments(path)
+	for i, s := range segments {
+		expired := false
+		if opts.MaxAge > 0 {
+			if st, err := os.Stat(s); err == nil && time.Since(st.ModTime()) > opts.MaxAge {
+				expired = true
+			}
+		}
+		if expired || (opts.MaxFiles > 0 && len(segments)-i > opts.MaxFiles) {
+			os.Remove(s)
+		}
+	}
+}
+
+// openSegment opens a log or rotated segment for reading, decompressing
+// gzipped segments
+func openSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return f, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// tailLines returns up to n complete lines from the end of a plain file,
+// reading backwards in blocks so large logs are not loaded whole
+func tailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const block = 64 << 10
+	var buf []byte
+	pos := st.Size()
+	for pos > 0 && bytes.Count(buf, []byte{'\n'}) <= n {
+		size := int64(block)
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if pos > 0 {
+		lines = lines[1:] // possibly cut off
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
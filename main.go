@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 //go:embed static/*
@@ -28,14 +33,110 @@ func main() {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
+	removeStaleTemps(dataDir)
+
 	// Initialize managers
-	configMgr := NewConfigManager(dataDir)
+	secrets, err := NewSecretStore(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize secret storage: %v", err)
+	}
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "json"
+	}
+	if err := migrateDataDir(dataDir, backend, secrets); err != nil {
+		log.Fatalf("Failed to migrate data directory: %v", err)
+	}
+
+	// One-shot conversion: fnos-frpc-gui convert-storage <from> <to>
+	if len(os.Args) > 1 && os.Args[1] == "convert-storage" {
+		if len(os.Args) != 4 {
+			log.Fatalf("Usage: %s convert-storage <from> <to> (backends: %v)", os.Args[0], storageBackends)
+		}
+		n, err := convertStorage(dataDir, os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatalf("Conversion failed: %v", err)
+		}
+		log.Printf("Copied %d servers from %s to %s; set STORAGE_BACKEND=%s to use it", n, os.Args[2], os.Args[3], os.Args[3])
+		return
+	}
+
+	store, err := openStorage(backend, dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open config storage: %v", err)
+	}
+	varStore := NewVariableStore(dataDir, secrets)
+	historyLimit := 50
+	if v, err := strconv.Atoi(os.Getenv("HISTORY_LIMIT")); err == nil && v > 0 {
+		historyLimit = v
+	}
+	historyMgr := NewHistoryManager(dataDir, historyLimit)
+	configMgr := NewConfigManager(store, secrets, varStore, historyMgr)
+	configMgr.expandEnvs = os.Getenv("EXPAND_ENVS") == "true"
 	processMgr := NewProcessManager(dataDir)
+	processMgr.restartPolicy = configMgr.RestartPolicy
+	processMgr.serverConfig = configMgr.RunnableToml
+	if v, err := strconv.Atoi(os.Getenv("LOG_MAX_SIZE")); err == nil && v > 0 {
+		processMgr.logRotation.MaxSize = int64(v) << 20
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOG_MAX_AGE")); err == nil && v >= 0 {
+		processMgr.logRotation.MaxAge = time.Duration(v) * 24 * time.Hour
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOG_MAX_FILES")); err == nil && v >= 0 {
+		processMgr.logRotation.MaxFiles = v
+	}
+	processMgr.logRotation.Compress = os.Getenv("LOG_COMPRESS") == "true"
 	versionMgr := NewVersionManager(dataDir)
 	authMgr := NewAuthManager(dataDir)
 
+	// Apply config changes to running servers according to their policy
+	applier := NewApplier(configMgr, processMgr)
+	configMgr.onCommit = applier.Schedule
+	go applier.Run()
+
+	// Optional Docker integration
+	var dockerMgr *DockerManager
+	if os.Getenv("DOCKER_DISCOVERY") == "true" {
+		socket := os.Getenv("DOCKER_SOCKET")
+		if socket == "" {
+			socket = "/var/run/docker.sock"
+		}
+		interval := 30 * time.Second
+		if v, err := strconv.Atoi(os.Getenv("DOCKER_SYNC_INTERVAL")); err == nil && v > 0 {
+			interval = time.Duration(v) * time.Second
+		}
+		dockerMgr = NewDockerManager(NewDockerClient(socket), configMgr, interval)
+		go dockerMgr.Run()
+		log.Printf("Docker integration enabled (socket: %s)", socket)
+	}
+
+	// Pick up hand edits of servers.json
+	var watcher *ConfigWatcher
+	if os.Getenv("WATCH_CONFIG") != "false" {
+		interval := 2 * time.Second
+		if v, err := strconv.Atoi(os.Getenv("WATCH_INTERVAL")); err == nil && v > 0 {
+			interval = time.Duration(v) * time.Second
+		}
+		watcher = NewConfigWatcher(configMgr, applier, store, interval)
+		if watcher != nil {
+			go watcher.Run()
+		} else {
+			log.Printf("Config watching is not supported by the %s storage backend", backend)
+		}
+	}
+
+	// Sample CPU and memory use of each frpc for the status API
+	metricsInterval := 5 * time.Second
+	if v, err := strconv.Atoi(os.Getenv("METRICS_INTERVAL")); err == nil && v > 0 {
+		metricsInterval = time.Duration(v) * time.Second
+	}
+	metrics := NewMetricsSampler(processMgr, metricsInterval)
+	if metrics != nil {
+		go metrics.Run()
+	}
+
 	// Create handler
-	handler := NewHandler(configMgr, processMgr, versionMgr, authMgr)
+	handler := NewHandler(configMgr, processMgr, versionMgr, authMgr, varStore, historyMgr, dockerMgr, watcher, applier, metrics)
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -48,18 +149,45 @@ func main() {
 	// Protected API routes
 	mux.Handle("GET /api/servers", authMgr.Middleware(http.HandlerFunc(handler.ListServers)))
 	mux.Handle("POST /api/servers", authMgr.Middleware(http.HandlerFunc(handler.CreateServer)))
+	mux.Handle("GET /api/servers/{id}", authMgr.Middleware(http.HandlerFunc(handler.GetServer)))
 	mux.Handle("PUT /api/servers/{id}", authMgr.Middleware(http.HandlerFunc(handler.UpdateServer)))
+	mux.Handle("PATCH /api/servers/{id}", authMgr.Middleware(http.HandlerFunc(handler.PatchServer)))
 	mux.Handle("DELETE /api/servers/{id}", authMgr.Middleware(http.HandlerFunc(handler.DeleteServer)))
+	mux.Handle("GET /api/servers/{id}/preview", authMgr.Middleware(http.HandlerFunc(handler.PreviewServer)))
+	mux.Handle("POST /api/servers/{id}/diagnose", authMgr.Middleware(http.HandlerFunc(handler.DiagnoseServer)))
 
 	mux.Handle("GET /api/servers/{id}/proxies", authMgr.Middleware(http.HandlerFunc(handler.ListProxies)))
 	mux.Handle("POST /api/servers/{id}/proxies", authMgr.Middleware(http.HandlerFunc(handler.CreateProxy)))
+	mux.Handle("GET /api/servers/{id}/proxies/{pid}", authMgr.Middleware(http.HandlerFunc(handler.GetProxy)))
 	mux.Handle("PUT /api/servers/{id}/proxies/{pid}", authMgr.Middleware(http.HandlerFunc(handler.UpdateProxy)))
+	mux.Handle("PATCH /api/servers/{id}/proxies/{pid}", authMgr.Middleware(http.HandlerFunc(handler.PatchProxy)))
 	mux.Handle("DELETE /api/servers/{id}/proxies/{pid}", authMgr.Middleware(http.HandlerFunc(handler.DeleteProxy)))
+	mux.Handle("POST /api/servers/{id}/proxies/{pid}/probe", authMgr.Middleware(http.HandlerFunc(handler.ProbeProxy)))
+
+	mux.Handle("GET /api/config/watch", authMgr.Middleware(http.HandlerFunc(handler.ConfigWatch)))
+	mux.Handle("GET /api/history", authMgr.Middleware(http.HandlerFunc(handler.ListHistory)))
+	mux.Handle("GET /api/history/diff", authMgr.Middleware(http.HandlerFunc(handler.DiffHistory)))
+	mux.Handle("GET /api/history/{sid}", authMgr.Middleware(http.HandlerFunc(handler.GetSnapshot)))
+	mux.Handle("POST /api/history/{sid}/rollback", authMgr.Middleware(http.HandlerFunc(handler.RollbackHistory)))
+
+	mux.Handle("GET /api/variables", authMgr.Middleware(http.HandlerFunc(handler.ListVariables)))
+	mux.Handle("PUT /api/variables/{name}", authMgr.Middleware(http.HandlerFunc(handler.SetVariable)))
+	mux.Handle("DELETE /api/variables/{name}", authMgr.Middleware(http.HandlerFunc(handler.DeleteVariable)))
+
+	mux.Handle("GET /api/discover/services", authMgr.Middleware(http.HandlerFunc(handler.DiscoverServices)))
 
 	mux.Handle("POST /api/servers/{id}/start", authMgr.Middleware(http.HandlerFunc(handler.StartServer)))
+	mux.Handle("GET /api/servers/{id}/pending", authMgr.Middleware(http.HandlerFunc(handler.PendingChanges)))
+	mux.Handle("POST /api/servers/{id}/apply", authMgr.Middleware(http.HandlerFunc(handler.ApplyChanges)))
 	mux.Handle("POST /api/servers/{id}/stop", authMgr.Middleware(http.HandlerFunc(handler.StopServer)))
 	mux.Handle("GET /api/servers/{id}/status", authMgr.Middleware(http.HandlerFunc(handler.ServerStatus)))
 	mux.Handle("GET /api/servers/{id}/logs", authMgr.Middleware(http.HandlerFunc(handler.ServerLogs)))
+	mux.Handle("GET /api/servers/{id}/logs/stream", authMgr.Middleware(http.HandlerFunc(handler.StreamLogs)))
+	mux.Handle("GET /api/servers/{id}/events", authMgr.Middleware(http.HandlerFunc(handler.ServerEvents)))
+
+	mux.Handle("GET /api/docker/containers", authMgr.Middleware(http.HandlerFunc(handler.DockerContainers)))
+	mux.Handle("GET /api/docker/suggestions", authMgr.Middleware(http.HandlerFunc(handler.DockerSuggestions)))
+	mux.Handle("POST /api/docker/reconcile", authMgr.Middleware(http.HandlerFunc(handler.DockerReconcile)))
 
 	mux.Handle("GET /api/frpc/version", authMgr.Middleware(http.HandlerFunc(handler.FrpcVersion)))
 	mux.Handle("GET /api/frpc/latest", authMgr.Middleware(http.HandlerFunc(handler.FrpcLatest)))
@@ -78,21 +206,72 @@ func main() {
 	if err != nil {
 		log.Printf("Failed to load servers for auto-start: %v", err)
 	} else {
+		known := make(map[string]bool, len(servers))
+		for _, server := range servers {
+			known[server.ID] = true
+		}
+
+		// frpc left running by a crashed instance would otherwise be
+		// started a second time
+		orphanPolicy := os.Getenv("ORPHAN_POLICY")
+		if orphanPolicy != orphanKill {
+			orphanPolicy = orphanAdopt
+		}
+		processMgr.RecoverOrphans(orphanPolicy, func(id string) bool {
+			running, ok := processMgr.runState.Desired(id)
+			return known[id] && (running || !ok)
+		})
+
 		for _, server := range servers {
-			// AutoStart is nil (default) or true -> start
-			if server.AutoStart == nil || *server.AutoStart {
-				log.Printf("Auto-starting server: %s", server.Name)
-				toml := configMgr.GenerateToml(&server)
-				if err := processMgr.Start(server.ID, toml); err != nil {
-					log.Printf("Failed to auto-start server %s: %v", server.Name, err)
-				}
+			// AutoStart false opts out; otherwise servers the user left
+			// stopped stay stopped and everything else starts
+			if server.AutoStart != nil && !*server.AutoStart {
+				continue
+			}
+			if running, ok := processMgr.runState.Desired(server.ID); ok && !running {
+				continue
+			}
+			if running, _ := processMgr.Status(server.ID); running {
+				continue
+			}
+			if err := configMgr.CheckRunnable(&server); err != nil {
+				log.Printf("Not auto-starting server %s: %v", server.Name, err)
+				continue
+			}
+			log.Printf("Auto-starting server: %s", server.Name)
+			toml := configMgr.GenerateToml(&server)
+			if err := processMgr.Start(server.ID, toml); err != nil {
+				log.Printf("Failed to auto-start server %s: %v", server.Name, err)
 			}
 		}
+		processMgr.runState.Retain(known)
 	}
 
-	log.Printf("fnos-frpc-gui starting on port %s", port)
-	log.Printf("Data directory: %s", dataDir)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), mux); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: mux}
+	// Log streams never end on their own
+	srv.RegisterOnShutdown(processMgr.CloseLogStreams)
+	go func() {
+		log.Printf("fnos-frpc-gui starting on port %s", port)
+		log.Printf("Data directory: %s", dataDir)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// docker stop and systemctl send SIGTERM; Ctrl+C sends SIGINT
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v, shutting down", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	processMgr.StopAll()
+	historyMgr.Flush()
+	if err := store.Close(); err != nil {
+		log.Printf("Failed to close config storage: %v", err)
 	}
+	log.Printf("Shutdown complete")
 }
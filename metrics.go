@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsHistorySize is how many samples are kept per server for charts
+const metricsHistorySize = 120
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc. It is 100 on every
+// architecture Linux runs on, including ARM.
+const clockTicks = 100
+
+// ProcessMetrics is one resource sample of a running frpc
+type ProcessMetrics struct {
+	Time        string   `json:"time"`
+	CPUPercent  *float64 `json:"cpuPercent"` // of one core, like top; nil for the first sample
+	RSS         int64    `json:"rssBytes"`
+	OpenFiles   int      `json:"openFiles"`
+	Threads     int      `json:"threads"`
+	Uptime      int64    `json:"uptimeSeconds"`
+	Connections int      `json:"connections"` // TCP sockets other than listeners
+}
+
+// MetricsReport is the latest sample of a server and the ones before it
+type MetricsReport struct {
+	Current ProcessMetrics   `json:"current"`
+	History []ProcessMetrics `json:"history"` // oldest first, including current
+}
+
+// cpuMark is the CPU time a process had used at a point in time
+type cpuMark struct {
+	pid   int
+	ticks int64
+	at    time.Time
+}
+
+// MetricsSampler reads the resource usage of each running frpc from
+// /proc/<pid> at a fixed interval
+type MetricsSampler struct {
+	process  *ProcessManager
+	interval time.Duration
+	samples  map[string][]ProcessMetrics
+	cpu      map[string]cpuMark
+	mu       sync.Mutex
+}
+
+// NewMetricsSampler returns nil where there is no /proc to read from
+func NewMetricsSampler(process *ProcessManager, interval time.Duration) *MetricsSampler {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		return nil
+	}
+	return &MetricsSampler{
+		process:  process,
+		interval: interval,
+		samples:  make(map[string][]ProcessMetrics),
+		cpu:      make(map[string]cpuMark),
+	}
+}
+
+// Run samples forever
+func (ms *MetricsSampler) Run() {
+	ms.Sample()
+	ticker := time.NewTicker(ms.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ms.Sample()
+	}
+}
+
+// Sample takes one sample of every running frpc. The history of servers
+// that are no longer running is dropped.
+func (ms *MetricsSampler) Sample() {
+	running := ms.process.runningProcesses()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id := range ms.samples {
+		if running[id] == nil {
+			delete(ms.samples, id)
+			delete(ms.cpu, id)
+		}
+	}
+	for id, info := range running {
+		now := time.Now()
+		pid := info.Process.Pid
+		m, ticks, err := readProcMetrics(pid)
+		if err != nil {
+			continue // exited in the meantime
+		}
+		m.Time = now.Format(time.RFC3339)
+		m.Uptime = int64(now.Sub(info.StartedAt).Seconds())
+
+		// CPU usage since the last sample. The first sample of a process has
+		// nothing to compare with, since an adopted process may have run for
+		// much longer than we know of.
+		if prev, ok := ms.cpu[id]; ok && prev.pid == pid {
+			if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+				cpu := math.Round(float64(ticks-prev.ticks)/clockTicks/elapsed*1000) / 10
+				m.CPUPercent = &cpu
+			}
+		}
+		ms.cpu[id] = cpuMark{pid: pid, ticks: ticks, at: now}
+
+		h := append(ms.samples[id], m)
+		if len(h) > 2*metricsHistorySize {
+			h = append([]ProcessMetrics(nil), h[len(h)-metricsHistorySize:]...)
+		}
+		ms.samples[id] = h
+	}
+}
+
+// Metrics returns the samples of a server, or nil if it is not running or
+// has not been sampled yet
+func (ms *MetricsSampler) Metrics(serverID string) *MetricsReport {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	h := ms.samples[serverID]
+	if len(h) == 0 {
+		return nil
+	}
+	if len(h) > metricsHistorySize {
+		h = h[len(h)-metricsHistorySize:]
+	}
+	return &MetricsReport{Current: h[len(h)-1], History: append([]ProcessMetrics(nil), h...)}
+}
+
+// readProcMetrics reads a sample of pid and the CPU time it has used in
+// clock ticks
+func readProcMetrics(pid int) (ProcessMetrics, int64, error) {
+	var m ProcessMetrics
+	dir := fmt.Sprintf("/proc/%d", pid)
+
+	// The command name in field 2 may contain spaces, so fields are
+	// counted from the closing parenthesis
+	b, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return m, 0, err
+	}
+	i := strings.LastIndexByte(string(b), ')')
+	fields := strings.Fields(string(b)[i+1:])
+	if i < 0 || len(fields) < 18 {
+		return m, 0, fmt.Errorf("unexpected format of %s/stat", dir)
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	m.Threads, _ = strconv.Atoi(fields[17])
+
+	if b, err := os.ReadFile(dir + "/statm"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 1 {
+			pages, _ := strconv.ParseInt(f[1], 10, 64)
+			m.RSS = pages * int64(os.Getpagesize())
+		}
+	}
+
+	sockets := make(map[string]bool)
+	fds, _ := os.ReadDir(dir + "/fd")
+	m.OpenFiles = len(fds)
+	for _, fd := range fds {
+		link, err := os.Readlink(dir + "/fd/" + fd.Name())
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			sockets[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+	m.Connections = countConnections(dir, sockets)
+	return m, utime + stime, nil
+}
+
+// countConnections counts the TCP sockets among inodes that are not
+// listening. The tables list every socket of the network namespace.
+func countConnections(dir string, inodes map[string]bool) int {
+	if len(inodes) == 0 {
+		return 0
+	}
+	n := 0
+	for _, table := range []string{"/net/tcp", "/net/tcp6"} {
+		b, err := os.ReadFile(dir + table)
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(b), "\n")
+		for _, line := range lines[1:] {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			f := strings.Fields(line)
+			if len(f) > 9 && f[3] != "0A" && inodes[f[9]] {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetricsFirstSampleHasNoCPU(t *testing.T) {
+	pm := NewProcessManager(t.TempDir())
+	ms := NewMetricsSampler(pm, time.Second)
+	if ms == nil {
+		t.Skip("no /proc")
+	}
+	// The test process stands in for an adopted frpc that has run for long
+	self, _ := os.FindProcess(os.Getpid())
+	pm.processes["s"] = &ProcessInfo{ServerID: "s", Process: self, Running: true, StartedAt: time.Now()}
+
+	ms.Sample()
+	report := ms.Metrics("s")
+	if report == nil || report.Current.CPUPercent != nil {
+		t.Fatalf("first sample: got %+v, want no CPU value", report)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ms.Sample()
+	report = ms.Metrics("s")
+	if report == nil || report.Current.CPUPercent == nil || len(report.History) != 2 {
+		t.Fatalf("second sample: got %+v, want a CPU value", report)
+	}
+}
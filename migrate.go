@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dataVersion is the data directory format written by this build. Add a
+// migration below whenever it changes.
+const dataVersion = 2
+
+// dataFiles are the files migrations may rewrite; they are backed up first
+var dataFiles = []string{"servers.json", "servers.kv", "auth.json", "variables.json"}
+
+// migration upgrades the data directory from version-1 to version
+type migration struct {
+	version int
+	name    string
+	run     func(store Storage, secrets *SecretStore) error
+}
+
+var migrations = []migration{
+	{1, "encrypt auth tokens", migrateEncryptTokens},
+	{2, "assign revisions", migrateAssignRevisions},
+}
+
+type versionFile struct {
+	Version   int    `json:"version"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func versionFilePath(dataDir string) string {
+	return filepath.Join(dataDir, "version.json")
+}
+
+// readDataVersion returns the format of dataDir. Directories written
+// before versioning existed are version 0; a directory without data is
+// reported as current.
+func readDataVersion(dataDir string) (int, error) {
+	var vf versionFile
+	err := readJSONFile(versionFilePath(dataDir), &vf)
+	if err == nil {
+		return vf.Version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, name := range dataFiles {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			return 0, nil
+		}
+	}
+	return dataVersion, nil
+}
+
+func writeDataVersion(dataDir string, version int) error {
+	b, err := json.MarshalIndent(versionFile{Version: version, UpdatedAt: time.Now().Format(time.RFC3339)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(versionFilePath(dataDir), b, 0600)
+}
+
+// migrateDataDir brings dataDir up to dataVersion, backing up the data
+// files before the first migration runs. Servers are migrated in the
+// storage backend in use. It refuses data written by a newer build rather
+// than risk damaging it.
+func migrateDataDir(dataDir, backend string, secrets *SecretStore) error {
+	current, err := readDataVersion(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data version: %v", err)
+	}
+	if current > dataVersion {
+		return fmt.Errorf("data directory %s has format version %d, but this build only supports up to %d; upgrade fnos-frpc-gui or restore a backup", dataDir, current, dataVersion)
+	}
+	if current == dataVersion {
+		if _, err := os.Stat(versionFilePath(dataDir)); os.IsNotExist(err) {
+			return writeDataVersion(dataDir, dataVersion)
+		}
+		return nil
+	}
+
+	backup, err := backupDataFiles(dataDir, current)
+	if err != nil {
+		return fmt.Errorf("failed to back up data before migrating: %v", err)
+	}
+	log.Printf("Migrating data from version %d to %d (backup in %s)", current, dataVersion, backup)
+
+	store, err := openStorage(backend, dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("Running migration %d: %s", m.version, m.name)
+		if err := m.run(store, secrets); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		// Record progress so a failed later step does not rerun this one
+		if err := writeDataVersion(dataDir, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupDataFiles copies the data files to DATA_DIR/backups/v<version>-<time>
+func backupDataFiles(dataDir string, version int) (string, error) {
+	dir := filepath.Join(dataDir, "backups", fmt.Sprintf("v%d-%s", version, time.Now().Format("20060102-150405")))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for _, name := range dataFiles {
+		b, err := os.ReadFile(filepath.Join(dataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, name), b, 0600); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// editServers applies fn to the stored servers as raw JSON objects, so
+// migrations do not depend on the current shape of ServerConfig
+func editServers(store Storage, fn func(servers []map[string]interface{}) error) error {
+	loaded, err := store.Load()
+	if err != nil || len(loaded) == 0 {
+		return err
+	}
+	b, err := json.Marshal(loaded)
+	if err != nil {
+		return err
+	}
+	var servers []map[string]interface{}
+	if err := json.Unmarshal(b, &servers); err != nil {
+		return err
+	}
+	if err := fn(servers); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(servers); err != nil {
+		return err
+	}
+	var next []ServerConfig
+	if err := json.Unmarshal(b, &next); err != nil {
+		return err
+	}
+	return store.Save(next)
+}
+
+// migrateEncryptTokens encrypts auth tokens stored in plain text
+func migrateEncryptTokens(store Storage, secrets *SecretStore) error {
+	return editServers(store, func(servers []map[string]interface{}) error {
+		for _, s := range servers {
+			token, _ := s["authToken"].(string)
+			if token == "" || strings.HasPrefix(token, secretPrefix) {
+				continue
+			}
+			sealed, err := secrets.Encrypt(token)
+			if err != nil {
+				return err
+			}
+			s["authToken"] = sealed
+		}
+		return nil
+	})
+}
+
+// migrateAssignRevisions starts servers and proxies at revision 1. Those
+// written before revisions existed load with revision 0.
+func migrateAssignRevisions(store Storage, secrets *SecretStore) error {
+	return editServers(store, func(servers []map[string]interface{}) error {
+		for _, s := range servers {
+			if r, _ := s["revision"].(float64); r == 0 {
+				s["revision"] = 1
+			}
+			proxies, _ := s["proxies"].([]interface{})
+			for _, p := range proxies {
+				if pm, ok := p.(map[string]interface{}); ok {
+					if r, _ := pm["revision"].(float64); r == 0 {
+						pm["revision"] = 1
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDataDir(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			secrets, err := NewSecretStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A version 0 directory: plain-text token, no revisions
+			store, err := openStorage(backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			legacy := []ServerConfig{{
+				ID: "s1", Name: "home", ServerAddr: "frps.example.com", ServerPort: 7000, AuthToken: "plain",
+				Proxies: []ProxyConfig{{ID: "p1", Name: "web", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 80}},
+			}}
+			if err := store.Save(legacy); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			os.Remove(versionFilePath(dir))
+
+			if err := migrateDataDir(dir, backend, secrets); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := readDataVersion(dir); err != nil || v != dataVersion {
+				t.Fatalf("data version %d (%v), want %d", v, err, dataVersion)
+			}
+
+			store, err = openStorage(backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			servers, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(servers) != 1 || len(servers[0].Proxies) != 1 {
+				t.Fatalf("unexpected servers %+v", servers)
+			}
+			s := servers[0]
+			if !strings.HasPrefix(s.AuthToken, secretPrefix) {
+				t.Fatalf("token not encrypted: %q", s.AuthToken)
+			}
+			if token, err := secrets.Decrypt(s.AuthToken); err != nil || token != "plain" {
+				t.Fatalf("token decrypts to %q (%v)", token, err)
+			}
+			if s.Revision != 1 || s.Proxies[0].Revision != 1 {
+				t.Fatalf("revisions %d/%d, want 1/1", s.Revision, s.Proxies[0].Revision)
+			}
+
+			// The data files were backed up as they were
+			backups, _ := filepath.Glob(filepath.Join(dir, "backups", "v0-*"))
+			if len(backups) != 1 {
+				t.Fatalf("got backups %v", backups)
+			}
+		})
+	}
+}
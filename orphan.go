@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Orphan policies decide what happens to frpc processes left running by a
+// previous instance of the GUI
+const (
+	orphanAdopt = "adopt" // default; monitor them as if we had started them
+	orphanKill  = "kill"
+)
+
+// pidFile records a running frpc in DATA_DIR/run/<server ID>.pid
+type pidFile struct {
+	PID           int    `json:"pid"`
+	Binary        string `json:"binary"`
+	Conf          string `json:"conf"`
+	StartedAt     string `json:"startedAt"`
+	AdminPort     int    `json:"adminPort,omitempty"`
+	AdminPassword string `json:"adminPassword,omitempty"`
+}
+
+// orphan is an frpc process found at startup
+type orphan struct {
+	pid      int
+	serverID string
+	conf     string
+	record   *pidFile // nil if its PID file is missing
+}
+
+func (pm *ProcessManager) pidPath(serverID string) string {
+	return filepath.Join(pm.dataDir, "run", serverID+".pid")
+}
+
+func (pm *ProcessManager) writePIDFile(info *ProcessInfo) {
+	b, err := json.MarshalIndent(pidFile{
+		PID:           info.Process.Pid,
+		Binary:        pm.frpcPath(),
+		Conf:          pm.confPath(info.ServerID),
+		StartedAt:     info.StartedAt.Format(time.RFC3339),
+		AdminPort:     info.AdminPort,
+		AdminPassword: info.adminPassword,
+	}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(pm.pidPath(info.ServerID), b, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to write PID file for server %s: %v", info.ServerID, err)
+	}
+}
+
+// removePIDFile removes the PID file of info unless it has already been
+// replaced by a newer process
+func (pm *ProcessManager) removePIDFile(info *ProcessInfo) {
+	var pf pidFile
+	path := pm.pidPath(info.ServerID)
+	if b, err := os.ReadFile(path); err == nil && json.Unmarshal(b, &pf) == nil && pf.PID != info.Process.Pid {
+		return
+	}
+	os.Remove(path)
+}
+
+// RecoverOrphans deals with frpc processes left running when a previous
+// instance crashed. They are found through the PID files and a scan of
+// /proc for processes whose config is in our conf directory. Depending on
+// policy they are adopted, so that they are supervised and can be stopped
+// as usual, or terminated. Processes for which want returns false, and
+// duplicates of an adopted process, are always terminated.
+func (pm *ProcessManager) RecoverOrphans(policy string, want func(serverID string) bool) {
+	orphans, err := pm.findOrphans()
+	if err != nil {
+		log.Printf("Cannot look for orphaned frpc processes: %v", err)
+		return
+	}
+
+	pm.mu.Lock()
+	var kill []*ProcessInfo
+	for _, o := range orphans {
+		info := pm.foreignProcess(o)
+		if _, taken := pm.processes[o.serverID]; taken || policy == orphanKill || !want(o.serverID) {
+			kill = append(kill, info)
+			continue
+		}
+		info.Running = true
+		info.follower = pm.followAdopted(o.serverID)
+		pm.processes[o.serverID] = info
+		// Earlier output is replayed, so the state is known once it logs again
+		pm.conns.Set(o.serverID, connStarting, "adopted from a previous instance")
+		go pm.monitor(info)
+		log.Printf("Adopted orphaned frpc for server %s (PID: %d)", o.serverID, o.pid)
+	}
+	pm.mu.Unlock()
+
+	for _, info := range kill {
+		go func(info *ProcessInfo) {
+			info.wait()
+			close(info.done)
+		}(info)
+		if err := info.terminate(stopGracePeriod); err != nil {
+			log.Printf("Failed to stop orphaned frpc (PID: %d): %v", info.Process.Pid, err)
+			continue
+		}
+		pm.removePIDFile(info)
+		log.Printf("Stopped orphaned frpc for server %s (PID: %d)", info.ServerID, info.Process.Pid)
+	}
+}
+
+// followAdopted follows the log of an adopted process from its current end.
+// pm.mu must be held.
+func (pm *ProcessManager) followAdopted(serverID string) *LogFollower {
+	out := pm.logs.Writer(serverID)
+	path := pm.logPath(serverID)
+	var offset int64
+	if st, err := os.Stat(path); err == nil {
+		offset = st.Size()
+	}
+	return FollowLog(path, offset, pm.logRotation, out)
+}
+
+// foreignProcess describes a process we did not start. Its exit status is
+// unknown, so waiting polls /proc until the process is gone. It still
+// writes to its log file, which is followed like that of a started one.
+func (pm *ProcessManager) foreignProcess(o orphan) *ProcessInfo {
+	proc, _ := os.FindProcess(o.pid) // always succeeds on Unix
+	info := &ProcessInfo{
+		ServerID:  o.serverID,
+		Process:   proc,
+		LogFile:   pm.logPath(o.serverID),
+		StartedAt: time.Now(),
+		State:     stateRunning,
+		done:      make(chan struct{}),
+	}
+	info.wait = func() error {
+		for procConfig(o.pid) == o.conf {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return fmt.Errorf("adopted process exited, status unknown")
+	}
+	if b, err := os.ReadFile(o.conf); err == nil {
+		// Strip the admin section appended by Start
+		toml := string(b)
+		if i := strings.Index(toml, "\n[webServer]\n"); i >= 0 {
+			toml = toml[:i]
+		}
+		info.Toml = toml
+	}
+	if o.record != nil {
+		info.AdminPort = o.record.AdminPort
+		info.adminPassword = o.record.AdminPassword
+		if t, err := time.Parse(time.RFC3339, o.record.StartedAt); err == nil {
+			info.StartedAt = t
+		}
+	}
+	return info
+}
+
+// findOrphans matches live frpc processes using our conf directory with
+// their PID files. PID files without a matching process are removed.
+func (pm *ProcessManager) findOrphans() ([]orphan, error) {
+	runDir := filepath.Join(pm.dataDir, "run")
+	records := make(map[int]*pidFile)
+	paths := make(map[int]string)
+	entries, _ := os.ReadDir(runDir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".pid") {
+			continue
+		}
+		path := filepath.Join(runDir, e.Name())
+		var pf pidFile
+		b, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(b, &pf) != nil {
+			os.Remove(path)
+			continue
+		}
+		records[pf.PID] = &pf
+		paths[pf.PID] = path
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if os.IsNotExist(err) {
+		// No /proc outside Linux; the process table cannot be checked
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	confDir, _ := filepath.Abs(filepath.Join(pm.dataDir, "conf"))
+	var orphans []orphan
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		conf := procConfig(pid)
+		abs, _ := filepath.Abs(conf)
+		if conf == "" || filepath.Dir(abs) != confDir || !strings.HasSuffix(conf, ".toml") {
+			continue
+		}
+		o := orphan{pid: pid, serverID: strings.TrimSuffix(filepath.Base(conf), ".toml"), conf: conf}
+		if pf := records[pid]; pf != nil && pf.Conf == conf {
+			o.record = pf
+			delete(paths, pid)
+		}
+		orphans = append(orphans, o)
+	}
+
+	// The rest belong to processes that are gone, or to reused PIDs
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return orphans, nil
+}
+
+// procConfig returns the -c argument of pid if it is an frpc process
+func procConfig(pid int) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	args := strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+	if !strings.HasPrefix(filepath.Base(args[0]), "frpc") {
+		return ""
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] == "-c" {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// mergePatch applies an RFC 7396 merge patch to target: objects are merged
+// recursively, null removes a member and any other value replaces it
+func mergePatch(target, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+			continue
+		}
+		tm[k] = mergePatch(tm[k], v)
+	}
+	return tm
+}
+
+// applyMergePatch patches the JSON form of the struct v points to. Members
+// removed by the patch are reset to their zero value.
+func applyMergePatch(v interface{}, patch []byte) error {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return fmt.Errorf("invalid merge patch: %v", err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return fmt.Errorf("merge patch must be a JSON object")
+	}
+
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergePatch(target, p))
+	if err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	if err := json.Unmarshal(merged, v); err != nil {
+		return fmt.Errorf("invalid merge patch: %v", err)
+	}
+	return nil
+}
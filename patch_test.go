@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	base := ProxyConfig{
+		ID: "p1", Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: 80,
+		CustomDomains: []string{"a.example.com"}, Subdomain: "web", Revision: 3,
+	}
+	with := func(edit func(p *ProxyConfig)) ProxyConfig {
+		p := base
+		p.CustomDomains = append([]string(nil), base.CustomDomains...)
+		edit(&p)
+		return p
+	}
+	tests := []struct {
+		name    string
+		patch   string
+		want    ProxyConfig
+		wantErr bool
+	}{
+		{"empty", `{}`, base, false},
+		{"replace", `{"localPort": 8080, "name": "site"}`, with(func(p *ProxyConfig) { p.LocalPort = 8080; p.Name = "site" }), false},
+		{"null deletes", `{"subdomain": null, "localIP": null}`, with(func(p *ProxyConfig) { p.Subdomain = ""; p.LocalIP = "" }), false},
+		{"null deletes lists", `{"customDomains": null}`, with(func(p *ProxyConfig) { p.CustomDomains = nil }), false},
+		{"lists are replaced", `{"customDomains": ["b.example.com"]}`, with(func(p *ProxyConfig) { p.CustomDomains = []string{"b.example.com"} }), false},
+		{"unknown members ignored", `{"bogus": 1}`, base, false},
+		{"wrong type", `{"localPort": "80"}`, base, true},
+		{"wrong list type", `{"customDomains": "a.example.com"}`, base, true},
+		{"not an object", `["name"]`, base, true},
+		{"null patch", `null`, base, true},
+		{"invalid JSON", `{"name":`, base, true},
+	}
+	for _, tt := range tests {
+		p := with(func(*ProxyConfig) {})
+		err := applyMergePatch(&p, []byte(tt.patch))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, p, tt.want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Nested objects are merged member by member
+	target := map[string]interface{}{"a": map[string]interface{}{"b": 1.0, "c": 2.0}, "d": 3.0}
+	patch := map[string]interface{}{"a": map[string]interface{}{"b": nil, "e": 4.0}, "d": map[string]interface{}{"f": 5.0}}
+	want := map[string]interface{}{"a": map[string]interface{}{"c": 2.0, "e": 4.0}, "d": map[string]interface{}{"f": 5.0}}
+	if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
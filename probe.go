@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const probeTimeout = 5 * time.Second
+
+// ProbeResult describes whether a proxy's local target is reachable from the GUI host
+type ProbeResult struct {
+	Target        string   `json:"target"`
+	Type          string   `json:"type"`
+	Reachable     bool     `json:"reachable"`
+	LatencyMs     float64  `json:"latencyMs"`
+	Error         string   `json:"error,omitempty"`
+	Note          string   `json:"note,omitempty"`
+	HTTPStatus    int      `json:"httpStatus,omitempty"`
+	HTTPLatencyMs float64  `json:"httpLatencyMs,omitempty"`
+	HTTPError     string   `json:"httpError,omitempty"`
+	TLS           *TLSInfo `json:"tls,omitempty"`
+}
+
+// TLSInfo summarizes a completed TLS handshake and the peer certificate
+type TLSInfo struct {
+	Version       string   `json:"version"`
+	CipherSuite   string   `json:"cipherSuite"`
+	Subject       string   `json:"subject,omitempty"`
+	Issuer        string   `json:"issuer,omitempty"`
+	DNSNames      []string `json:"dnsNames,omitempty"`
+	NotBefore     string   `json:"notBefore,omitempty"`
+	NotAfter      string   `json:"notAfter,omitempty"`
+	ExpiresInDays int      `json:"expiresInDays"`
+	Verified      bool     `json:"verified"`
+	VerifyError   string   `json:"verifyError,omitempty"`
+}
+
+// ProbeProxy checks the local side of a proxy: a TCP dial or UDP datagram,
+// followed by an HTTP(S) request for http/https proxies
+func ProbeProxy(p ProxyConfig) *ProbeResult {
+	localIP := p.LocalIP
+	if localIP == "" {
+		localIP = "127.0.0.1"
+	}
+	target := net.JoinHostPort(localIP, strconv.Itoa(p.LocalPort))
+	result := &ProbeResult{Target: target, Type: p.Type}
+
+	if p.Type == "udp" {
+		probeUDP(target, result)
+		return result
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", target, probeTimeout)
+	if err != nil {
+		result.Error = describeDialError(err)
+		return result
+	}
+	conn.Close()
+	result.Reachable = true
+	result.LatencyMs = msSince(start)
+
+	switch p.Type {
+	case "http", "https":
+		probeHTTP(p, target, result)
+	}
+	return result
+}
+
+func probeUDP(target string, result *ProbeResult) {
+	start := time.Now()
+	conn, err := net.DialTimeout("udp", target, probeTimeout)
+	if err != nil {
+		result.Error = describeDialError(err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{0}); err != nil {
+		result.Error = describeDialError(err)
+		return
+	}
+
+	// A closed UDP port usually answers with ICMP port unreachable, which
+	// surfaces as ECONNREFUSED on the next read of a connected socket.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	switch {
+	case err == nil:
+		result.Reachable = true
+		result.LatencyMs = msSince(start)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Error = "port unreachable (nothing is listening)"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		result.Reachable = true
+		result.LatencyMs = msSince(start)
+		result.Note = "no reply within 1s; UDP is connectionless, so the service may still be listening"
+	default:
+		result.Error = describeDialError(err)
+	}
+}
+
+func probeHTTP(p ProxyConfig, target string, result *ProbeResult) {
+	scheme := "http"
+	if p.Type == "https" {
+		scheme = "https"
+	}
+
+	// frps forwards the original Host header, so ask with the first domain
+	// to hit the same virtual host the remote side would.
+	host := ""
+	if len(p.CustomDomains) > 0 {
+		host = p.CustomDomains[0]
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/", scheme, target), nil)
+	if err != nil {
+		result.HTTPError = err.Error()
+		return
+	}
+	if host != "" {
+		req.Host = host
+	}
+	req.Header.Set("User-Agent", "fnos-frpc-gui probe")
+
+	client := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			Proxy: nil,
+			// The certificate is verified separately so that a self-signed
+			// local service still gets an HTTP status in the report.
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: host},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.HTTPError = err.Error()
+		return
+	}
+	resp.Body.Close()
+	result.HTTPLatencyMs = msSince(start)
+	result.HTTPStatus = resp.StatusCode
+
+	if resp.TLS != nil {
+		result.TLS = describeTLS(resp.TLS, host)
+	}
+}
+
+// describeTLS converts a connection state into a TLSInfo, verifying the
+// peer chain against the system roots for serverName when one is given
+func describeTLS(state *tls.ConnectionState, serverName string) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) == 0 {
+		return info
+	}
+
+	leaf := state.PeerCertificates[0]
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.DNSNames = leaf.DNSNames
+	info.NotBefore = leaf.NotBefore.Format(time.RFC3339)
+	info.NotAfter = leaf.NotAfter.Format(time.RFC3339)
+	info.ExpiresInDays = int(time.Until(leaf.NotAfter).Hours() / 24)
+
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		info.VerifyError = err.Error()
+	} else {
+		info.Verified = true
+	}
+	return info
+}
+
+func describeDialError(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused (nothing is listening)"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timed out (host unreachable or filtered)"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timed out (host unreachable or filtered)"
+	}
+	return strings.TrimSpace(err.Error())
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
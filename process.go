@@ -2,38 +2,99 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type ProcessInfo struct {
 	ServerID string
-	Cmd      *exec.Cmd
+	Cmd      *exec.Cmd // nil for processes adopted from a previous instance
+	Process  *os.Process
+	wait     func() error
 	LogFile  string
 	Running  bool
+	Toml     string // config the process runs, without the admin section
+
+	// frpc admin API used for hot reloads; AdminPort is 0 if unavailable
+	AdminPort     int
+	adminPassword string
+
+	// Supervision, see supervisor.go
+	StartedAt    time.Time
+	State        string
+	Restarts     int
+	LastExit     string
+	NextRestart  time.Time
+	restartTimer *time.Timer
+	follower     *LogFollower
+	done         chan struct{} // closed once the process has exited
 }
 
+// stopGracePeriod is how long frpc may take to exit after SIGTERM before
+// it is killed
+const stopGracePeriod = 5 * time.Second
+
 type ProcessManager struct {
-	dataDir   string
-	processes map[string]*ProcessInfo
-	mu        sync.RWMutex
+	dataDir     string
+	processes   map[string]*ProcessInfo
+	runState    *RunState
+	logs        *LogHub
+	events      *EventLog
+	conns       *ConnTracker
+	logRotation LogRotation // applies to logs opened after it is set
+	closed      bool        // set by StopAll; nothing is started afterwards
+	mu          sync.RWMutex
+
+	// restartPolicy returns the restart policy and restart limit of a
+	// server; without it exited servers are never restarted
+	restartPolicy func(serverID string) (string, int)
+	// serverConfig returns the current config of a server for automatic
+	// restarts; without it the config of the exited run is reused
+	serverConfig func(serverID string) (string, error)
 }
 
 func NewProcessManager(dataDir string) *ProcessManager {
 	logsDir := filepath.Join(dataDir, "logs")
 	os.MkdirAll(logsDir, 0755)
+	// Generated configs contain the auth token
 	confDir := filepath.Join(dataDir, "conf")
-	os.MkdirAll(confDir, 0755)
+	os.MkdirAll(confDir, 0700)
+	os.Chmod(confDir, 0700)
+	// PID files hold the admin API password
+	os.MkdirAll(filepath.Join(dataDir, "run"), 0700)
 
-	return &ProcessManager{
-		dataDir:   dataDir,
-		processes: make(map[string]*ProcessInfo),
+	pm := &ProcessManager{
+		dataDir:     dataDir,
+		processes:   make(map[string]*ProcessInfo),
+		runState:    NewRunState(dataDir),
+		logRotation: defaultLogRotation,
 	}
+	pm.logs = NewLogHub(func(serverID string) []string {
+		tail, err := pm.GetLogs(serverID, logHistorySize)
+		if err != nil || tail == "" {
+			return nil
+		}
+		return strings.Split(tail, "\n")
+	})
+	pm.events = NewEventLog()
+	pm.conns = NewConnTracker()
+	pm.logs.Observe(func(serverID string, line LogLine) {
+		// Old lines describe earlier runs, not the current connection
+		if ev, ok := pm.events.Record(serverID, line); ok && !line.replayed {
+			pm.conns.Observe(serverID, ev)
+		}
+	})
+	return pm
 }
 
 func (pm *ProcessManager) frpcPath() string {
@@ -56,82 +117,251 @@ func (pm *ProcessManager) Start(serverID string, tomlContent string) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
+	if pm.closed {
+		return fmt.Errorf("shutting down")
+	}
 	// Check if already running
-	if info, ok := pm.processes[serverID]; ok && info.Running {
-		return fmt.Errorf("server %s is already running", serverID)
+	if info, ok := pm.processes[serverID]; ok {
+		if info.Running {
+			return fmt.Errorf("server %s is already running", serverID)
+		}
+		info.cancelRestart()
 	}
 
+	if _, err := pm.spawn(serverID, tomlContent, nil); err != nil {
+		return err
+	}
+	pm.runState.Set(serverID, true)
+	return nil
+}
+
+// spawn starts frpc. prev is the process being replaced by an automatic
+// restart, whose restart count is carried over and whose log is continued.
+// pm.mu must be held.
+func (pm *ProcessManager) spawn(serverID string, tomlContent string, prev *ProcessInfo) (*ProcessInfo, error) {
 	// Check frpc binary
 	frpcPath := pm.frpcPath()
 	if _, err := os.Stat(frpcPath); err != nil {
-		return fmt.Errorf("frpc binary not found, please install frpc first")
+		return nil, fmt.Errorf("frpc binary not found, please install frpc first")
+	}
+
+	// Enable the admin API on a loopback port so the config can be reloaded
+	adminPort, err := freeLocalPort()
+	if err != nil {
+		log.Printf("No admin port for server %s, hot reload disabled: %v", serverID, err)
 	}
+	adminPassword := generateID()
 
 	// Write config file
 	confFile := pm.confPath(serverID)
-	if err := os.WriteFile(confFile, []byte(tomlContent), 0644); err != nil {
-		return fmt.Errorf("failed to write config: %v", err)
+	if err := os.WriteFile(confFile, []byte(tomlContent+adminSection(adminPort, adminPassword)), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write config: %v", err)
 	}
+	os.Chmod(confFile, 0600)
 
-	// Open log file
+	// frpc appends to its log file directly, which keeps earlier runs
+	// until they age out. The follower publishes new lines and rotates it.
 	logFile := pm.logPath(serverID)
-	lf, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	out := pm.logs.Writer(serverID) // loads the existing lines first
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create log file: %v", err)
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer f.Close() // frpc has its own copy once started
+	st, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	if prev != nil {
+		fmt.Fprintf(f, "--- %s restarted after: %s ---\n", time.Now().Format("2006-01-02 15:04:05"), prev.LastExit)
+	} else {
+		fmt.Fprintf(f, "--- %s started ---\n", time.Now().Format("2006-01-02 15:04:05"))
 	}
 
 	// Start frpc
 	cmd := exec.Command(frpcPath, "-c", confFile)
-	cmd.Stdout = lf
-	cmd.Stderr = lf
+	cmd.Stdout = f
+	cmd.Stderr = f
 
+	// Set before starting so no output is observed ahead of it
+	pm.conns.Set(serverID, connStarting, "")
+	follower := FollowLog(logFile, st.Size(), pm.logRotation, out)
 	if err := cmd.Start(); err != nil {
-		lf.Close()
-		return fmt.Errorf("failed to start frpc: %v", err)
+		follower.Close()
+		err = fmt.Errorf("failed to start frpc: %v", err)
+		pm.conns.Set(serverID, connCrashed, err.Error())
+		return nil, err
 	}
 
 	info := &ProcessInfo{
-		ServerID: serverID,
-		Cmd:      cmd,
-		LogFile:  logFile,
-		Running:  true,
+		ServerID:      serverID,
+		Cmd:           cmd,
+		Process:       cmd.Process,
+		wait:          cmd.Wait,
+		LogFile:       logFile,
+		Running:       true,
+		Toml:          tomlContent,
+		AdminPort:     adminPort,
+		adminPassword: adminPassword,
+		StartedAt:     time.Now(),
+		State:         stateRunning,
+		follower:      follower,
+		done:          make(chan struct{}),
+	}
+	if prev != nil {
+		info.Restarts = prev.Restarts
+		info.LastExit = prev.LastExit
 	}
 	pm.processes[serverID] = info
+	pm.writePIDFile(info)
 
 	// Monitor process in background
-	go func() {
-		cmd.Wait()
-		lf.Close()
-		pm.mu.Lock()
-		if p, ok := pm.processes[serverID]; ok && p.Cmd == cmd {
-			p.Running = false
-		}
-		pm.mu.Unlock()
-		log.Printf("frpc process for server %s exited", serverID)
-	}()
+	go pm.monitor(info)
 
 	log.Printf("frpc started for server %s (PID: %d)", serverID, cmd.Process.Pid)
-	return nil
+	return info, nil
 }
 
+// Stop asks frpc to exit and waits for it, killing it if it does not exit
+// within stopGracePeriod. A server that is waiting to be restarted or has
+// exited for good is stopped too, so that it stays stopped on the next boot.
 func (pm *ProcessManager) Stop(serverID string) error {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
 	info, ok := pm.processes[serverID]
+	if ok && !info.Running && (info.State == stateBackoff || info.State == stateCrashLoop || info.State == stateExited) {
+		state := info.State
+		info.cancelRestart()
+		pm.conns.Set(serverID, connStopped, "")
+		pm.mu.Unlock()
+		pm.runState.Set(serverID, false)
+		log.Printf("Stopped server %s (was %s)", serverID, state)
+		return nil
+	}
 	if !ok || !info.Running {
+		pm.mu.Unlock()
 		return fmt.Errorf("server %s is not running", serverID)
 	}
+	// Marked first so the monitor does not treat the exit as a crash
+	info.Running = false
+	info.State = stateStopped
+	pm.conns.Set(serverID, connStopped, "")
+	pm.mu.Unlock()
 
-	if err := info.Cmd.Process.Kill(); err != nil {
+	pm.runState.Set(serverID, false)
+	if err := info.terminate(stopGracePeriod); err != nil {
 		return fmt.Errorf("failed to stop frpc: %v", err)
 	}
-
-	info.Running = false
 	log.Printf("frpc stopped for server %s", serverID)
 	return nil
 }
 
+// terminate sends SIGTERM and waits up to grace for the process to exit
+// before killing it. Windows has no SIGTERM, so the process is killed
+// right away there.
+func (info *ProcessInfo) terminate(grace time.Duration) error {
+	if err := info.Process.Signal(syscall.SIGTERM); err != nil {
+		if err := info.Process.Kill(); err != nil && err != os.ErrProcessDone {
+			return err
+		}
+	}
+	select {
+	case <-info.done:
+		return nil
+	case <-time.After(grace):
+	}
+	log.Printf("frpc for server %s did not exit within %s, killing it", info.ServerID, grace)
+	if err := info.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	<-info.done
+	return nil
+}
+
+// cancelRestart drops a pending automatic restart. pm.mu must be held.
+func (info *ProcessInfo) cancelRestart() {
+	if info.restartTimer != nil {
+		info.restartTimer.Stop()
+		info.restartTimer = nil
+	}
+	info.State = stateStopped
+}
+
+// Reload rewrites the config of a running server and asks frpc to apply
+// it through the admin API. frpc only reloads proxies; global settings
+// such as the server address need a restart.
+func (pm *ProcessManager) Reload(serverID string, tomlContent string) error {
+	pm.mu.Lock()
+	info, ok := pm.processes[serverID]
+	if !ok || !info.Running {
+		pm.mu.Unlock()
+		return fmt.Errorf("server %s is not running", serverID)
+	}
+	if info.AdminPort == 0 {
+		pm.mu.Unlock()
+		return fmt.Errorf("admin API is not available for server %s", serverID)
+	}
+	port, password := info.AdminPort, info.adminPassword
+	err := os.WriteFile(pm.confPath(serverID), []byte(tomlContent+adminSection(port, password)), 0600)
+	pm.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/api/reload", port), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("admin", password)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("reload request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("frpc rejected reload: HTTP %d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	pm.mu.Lock()
+	if pm.processes[serverID] == info {
+		info.Toml = tomlContent
+	}
+	pm.mu.Unlock()
+	log.Printf("frpc config reloaded for server %s", serverID)
+	return nil
+}
+
+// RunningToml returns the config a running server was started or last
+// reloaded with
+func (pm *ProcessManager) RunningToml(serverID string) (string, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	info, ok := pm.processes[serverID]
+	if !ok || !info.Running {
+		return "", false
+	}
+	return info.Toml, true
+}
+
+func adminSection(port int, password string) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n[webServer]\naddr = \"127.0.0.1\"\nport = %d\nuser = \"admin\"\npassword = \"%s\"\n", port, password)
+}
+
+// freeLocalPort asks the kernel for an unused loopback port
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
 func (pm *ProcessManager) Status(serverID string) (bool, int) {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
@@ -142,43 +372,123 @@ func (pm *ProcessManager) Status(serverID string) (bool, int) {
 	}
 
 	pid := 0
-	if info.Cmd != nil && info.Cmd.Process != nil {
-		pid = info.Cmd.Process.Pid
+	if info.Process != nil {
+		pid = info.Process.Pid
 	}
 	return info.Running, pid
 }
 
+// GetLogs returns the last lines of a server's log, continuing into rotated
+// segments when the current log is shorter
 func (pm *ProcessManager) GetLogs(serverID string, lines int) (string, error) {
 	logFile := pm.logPath(serverID)
-	b, err := os.ReadFile(logFile)
-	if err != nil {
+	if lines <= 0 {
+		b, err := os.ReadFile(logFile)
 		if os.IsNotExist(err) {
 			return "", nil
 		}
-		return "", err
+		return string(b), err
+	}
+
+	segments := append(logSegments(logFile), logFile)
+	var result []string
+	for i := len(segments) - 1; i >= 0 && len(result) < lines; i-- {
+		tail, err := lastLines(segments[i], lines-len(result))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		result = append(tail, result...)
 	}
+	return strings.Join(result, "\n"), nil
+}
+
+// SubscribeLogs follows the output of a server, see LogHub.Subscribe
+func (pm *ProcessManager) SubscribeLogs(serverID, lastEventID string, n int) *LogSubscription {
+	return pm.logs.Subscribe(serverID, lastEventID, n)
+}
+
+// Events returns parsed events of a server's output
+func (pm *ProcessManager) Events(serverID string, q EventQuery) []LogEvent {
+	// Events of earlier runs come from the log file
+	pm.logs.Load(serverID)
+	return pm.events.Query(serverID, q)
+}
 
-	content := string(b)
-	if lines > 0 {
-		allLines := strings.Split(content, "\n")
-		if len(allLines) > lines {
-			allLines = allLines[len(allLines)-lines:]
+// runningProcesses returns the frpc processes that are running
+func (pm *ProcessManager) runningProcesses() map[string]*ProcessInfo {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	running := make(map[string]*ProcessInfo)
+	for id, info := range pm.processes {
+		if info.Running {
+			running[id] = info
 		}
-		content = strings.Join(allLines, "\n")
 	}
+	return running
+}
+
+// Connection returns the connection state of a server, see ConnTracker
+func (pm *ProcessManager) Connection(serverID string) ConnectionStatus {
+	return pm.conns.Status(serverID)
+}
+
+// CloseLogStreams ends all log subscriptions
+func (pm *ProcessManager) CloseLogStreams() {
+	pm.logs.Close()
+}
 
-	return content, nil
+// lastLines returns the last n lines of a log or rotated segment.
+// Compressed segments have to be read from the start.
+func lastLines(path string, n int) ([]string, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return tailLines(path, n)
+	}
+	rc, err := openSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	all := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	return all, nil
 }
 
+// StopAll stops every frpc in parallel for shutdown. Unlike Stop it keeps
+// the run state, so the servers are started again on the next boot.
 func (pm *ProcessManager) StopAll() {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	for id, info := range pm.processes {
+	pm.closed = true
+	var stopping []*ProcessInfo
+	for _, info := range pm.processes {
+		info.cancelRestart()
 		if info.Running {
-			info.Cmd.Process.Kill()
 			info.Running = false
-			log.Printf("frpc stopped for server %s (shutdown)", id)
+			stopping = append(stopping, info)
 		}
 	}
+	pm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, info := range stopping {
+		wg.Add(1)
+		go func(info *ProcessInfo) {
+			defer wg.Done()
+			if err := info.terminate(stopGracePeriod); err != nil {
+				log.Printf("Failed to stop frpc for server %s: %v", info.ServerID, err)
+				return
+			}
+			log.Printf("frpc stopped for server %s (shutdown)", info.ServerID)
+		}(info)
+	}
+	wg.Wait()
 }
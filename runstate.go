@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RunState remembers which servers the user left running, so they can be
+// restored when the GUI starts again. Shutting the GUI down does not
+// change it.
+type RunState struct {
+	path    string
+	running map[string]bool
+	mu      sync.Mutex
+}
+
+type runStateFile struct {
+	Servers map[string]bool `json:"servers"` // server ID -> should be running
+}
+
+func NewRunState(dataDir string) *RunState {
+	rs := &RunState{path: filepath.Join(dataDir, "runstate.json"), running: make(map[string]bool)}
+	var f runStateFile
+	if err := readJSONFile(rs.path, &f); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read run state: %v", err)
+		}
+	} else if f.Servers != nil {
+		rs.running = f.Servers
+	}
+	return rs
+}
+
+// Desired returns whether a server should be running. known is false for
+// servers that were never started or stopped.
+func (rs *RunState) Desired(serverID string) (running, known bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	running, known = rs.running[serverID]
+	return running, known
+}
+
+func (rs *RunState) Set(serverID string, running bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if prev, ok := rs.running[serverID]; ok && prev == running {
+		return
+	}
+	rs.running[serverID] = running
+	rs.save()
+}
+
+// Retain forgets servers that are not in ids
+func (rs *RunState) Retain(ids map[string]bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	changed := false
+	for id := range rs.running {
+		if !ids[id] {
+			delete(rs.running, id)
+			changed = true
+		}
+	}
+	if changed {
+		rs.save()
+	}
+}
+
+func (rs *RunState) save() {
+	b, err := json.MarshalIndent(runStateFile{Servers: rs.running}, "", "  ")
+	if err == nil {
+		err = writeJSONFile(rs.path, b, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to save run state: %v", err)
+	}
+}
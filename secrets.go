@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// secretPrefix marks an encrypted value; anything without it is treated as
+// legacy plain text and encrypted on the next save
+const secretPrefix = "enc:v1:"
+
+// SecretStore encrypts secret config fields with AES-256-GCM
+type SecretStore struct {
+	aead cipher.AEAD
+}
+
+// NewSecretStore loads the key from SECRET_KEY, or from DATA_DIR/secret.key,
+// generating the key file on first use
+func NewSecretStore(dataDir string) (*SecretStore, error) {
+	key, err := loadSecretKey(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStore{aead: aead}, nil
+}
+
+func loadSecretKey(dataDir string) ([]byte, error) {
+	if env := os.Getenv("SECRET_KEY"); env != "" {
+		return parseSecretKey(env), nil
+	}
+
+	path := filepath.Join(dataDir, "secret.key")
+	b, err := os.ReadFile(path)
+	if err == nil {
+		// Tighten permissions on key files created by hand
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+			os.Chmod(path, 0600)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid secret key file %s", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read secret key: %v", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write secret key: %v", err)
+	}
+	return key, nil
+}
+
+// parseSecretKey accepts a 32-byte key in hex or base64; any other value is
+// treated as a passphrase and hashed
+func parseSecretKey(s string) []byte {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// Encrypt returns the sealed form of plain; empty values stay empty. A
+// value that looks sealed already is encrypted all the same, since callers
+// only pass plain text; skipping sealed values is up to them.
+func (ss *SecretStore) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return plain, nil
+	}
+	nonce := make([]byte, ss.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := ss.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt; plain text passes through
+func (ss *SecretStore) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	n := ss.aead.NonceSize()
+	if len(raw) < n {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plain, err := ss.aead.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret (wrong SECRET_KEY?)")
+	}
+	return string(plain), nil
+}
+
+// secretStatus reports a write-only field as "set" or "unset"
+func secretStatus(value string) string {
+	if value == "" {
+		return "unset"
+	}
+	return "set"
+}
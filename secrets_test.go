@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretRoundTrip(t *testing.T) {
+	ss, err := NewSecretStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{
+		"",
+		"token",
+		"enc:v1:",
+		"enc:v1:not-base64!",
+		secretPrefix + "c2VhbGVk", // looks sealed but comes from a user
+		"密码 with spaces\n",
+	} {
+		sealed, err := ss.Encrypt(plain)
+		if err != nil {
+			t.Fatalf("%q: %v", plain, err)
+		}
+		if plain != "" && (sealed == plain || !strings.HasPrefix(sealed, secretPrefix)) {
+			t.Fatalf("%q was not encrypted: %q", plain, sealed)
+		}
+		got, err := ss.Decrypt(sealed)
+		if err != nil || got != plain {
+			t.Fatalf("%q decrypts to %q (%v)", plain, got, err)
+		}
+	}
+}
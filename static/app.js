@@ -4,14 +4,18 @@ let servers = [];
 let selectedServerId = null;
 let editingServerId = null;
 let editingProxyId = null;
+let editingRevision = null;
 let frpcInstalled = false;
 
 // === API Helper ===
-async function api(method, path, body = null) {
+async function api(method, path, body = null, revision = null) {
     const opts = {
         method,
         headers: { 'Content-Type': 'application/json' },
     };
+    if (revision !== null) {
+        opts.headers['If-Match'] = `"${revision}"`;
+    }
     if (authToken) {
         opts.headers['X-Auth-Token'] = authToken;
     }
@@ -20,6 +24,12 @@ async function api(method, path, body = null) {
     }
     const res = await fetch(`/api${path}`, opts);
     const data = await res.json();
+    if (res.status === 412) {
+        throw new Error('配置已被其他人修改，请刷新后重试');
+    }
+    if (res.status === 422 && data.errors) {
+        throw new Error(data.errors.map(e => `${e.field}: ${e.message}`).join('; '));
+    }
     if (!res.ok) {
         throw new Error(data.error || `HTTP ${res.status}`);
     }
@@ -145,6 +155,9 @@ document.getElementById('btn-logout').addEventListener('click', () => {
     authToken = '';
     localStorage.removeItem('authToken');
     selectedServerId = null;
+    stopLogStream();
+    clearTimeout(connPollTimer);
+    clearTimeout(metricsTimer);
     showPage('login-page');
     toast('\u5df2\u9000\u51fa\u767b\u5f55', 'info');
 });
@@ -154,11 +167,55 @@ async function loadServers() {
     try {
         servers = await api('GET', '/servers');
         renderServerList();
+        scheduleConnectionPoll();
     } catch (e) {
         toast('加载服务器列表失败: ' + e.message, 'error');
     }
 }
 
+// Connection states that settle within seconds are polled until they do
+const CONN_TRANSIENT = ['starting', 'connecting', 'reconnecting'];
+let connPollTimer = null;
+
+function scheduleConnectionPoll() {
+    clearTimeout(connPollTimer);
+    if (!servers.some(s => s.connection && CONN_TRANSIENT.includes(s.connection.state))) return;
+    connPollTimer = setTimeout(async () => {
+        await loadServers();
+        if (selectedServerId) renderServerDetail();
+    }, 3000);
+}
+
+// Indicator class for a server: green only once frpc is logged in to frps
+function connectionClass(s) {
+    const state = s.connection ? s.connection.state : (s.running ? 'connected' : 'stopped');
+    switch (state) {
+        case 'connected': return 'running';
+        case 'auth_failed':
+        case 'crashed': return 'error';
+        case 'stopped': return 'stopped';
+        default: return 'pending';
+    }
+}
+
+const CONN_LABELS = {
+    starting: '启动中',
+    connecting: '正在连接服务器',
+    connected: '已连接',
+    auth_failed: '认证失败',
+    reconnecting: '连接断开，正在重连',
+    stopped: '未运行',
+    crashed: '异常退出',
+};
+
+function connectionItem(conn) {
+    if (!conn) return '';
+    let text = CONN_LABELS[conn.state] || conn.state;
+    if (conn.since) text += `（${new Date(conn.since).toLocaleString()} 起）`;
+    if (conn.reason && conn.state !== 'connected') text += `：${conn.reason}`;
+    return `<div class="config-item"><div class="label">连接状态</div><div class="value">${escapeHtml(text)}</div></div>`;
+}
+
 function renderServerList() {
     const list = document.getElementById('server-list');
 
@@ -169,7 +226,7 @@ function renderServerList() {
 
     list.innerHTML = servers.map(s => `
         <div class="server-item ${s.id === selectedServerId ? 'active' : ''}" data-id="${s.id}" onclick="selectServer('${s.id}')">
-            <span class="status-indicator ${s.running ? 'running' : 'stopped'}"></span>
+            <span class="status-indicator ${connectionClass(s)}"></span>
             <div>
                 <div class="server-name">${escapeHtml(s.name)}</div>
                 <div class="server-addr">${escapeHtml(s.serverAddr)}:${s.serverPort}</div>
@@ -188,6 +245,7 @@ function selectServer(id) {
 function renderServerDetail() {
     const server = servers.find(s => s.id === selectedServerId);
     if (!server) {
+        stopLogStream();
         document.getElementById('no-selection').classList.remove('hidden');
         document.getElementById('server-detail').classList.add('hidden');
         return;
@@ -204,12 +262,13 @@ function renderServerDetail() {
     const toggleText = document.getElementById('btn-toggle-text');
     const toggleBtn = document.getElementById('btn-toggle-server');
 
+    document.getElementById('btn-apply-server').classList.toggle('hidden', !server.configDirty);
+
+    dot.className = 'status-indicator ' + connectionClass(server);
     if (server.running) {
-        dot.className = 'status-indicator running';
         toggleText.textContent = '停止';
         toggleBtn.classList.add('btn-danger');
     } else {
-        dot.className = 'status-indicator stopped';
         toggleText.textContent = '启动';
         toggleBtn.classList.remove('btn-danger');
     }
@@ -227,20 +286,113 @@ function renderServerDetail() {
         </div>
         <div class="config-item">
             <div class="label">Token</div>
-            <div class="value">${server.authToken ? '••••••••' : '未设置'}</div>
+            <div class="value">${server.authTokenStatus === 'set' ? '••••••••' : '未设置'}</div>
         </div>
         <div class="config-item">
             <div class="label">TLS</div>
             <div class="value">${server.tlsEnable ? '已启用' : '未启用'}</div>
         </div>
         ${server.user ? `<div class="config-item"><div class="label">用户名</div><div class="value">${escapeHtml(server.user)}</div></div>` : ''}
+        ${connectionItem(server.connection)}
+        ${supervisorItem(server.supervisor)}
     `;
 
+    loadMetrics();
+
     // Proxies
     renderProxyTable(server.proxies || []);
 
     // Logs
-    refreshLogs();
+    followLogs();
+}
+
+// Shows why frpc is not running after it exited on its own
+function supervisorItem(sup) {
+    if (!sup) return '';
+    let text;
+    switch (sup.state) {
+        case 'backoff':
+            text = `frpc 已退出，将于 ${new Date(sup.nextRestart).toLocaleTimeString()} 自动重启（第 ${sup.restarts + 1} 次）`;
+            break;
+        case 'crash-loop':
+            text = `frpc 反复退出，已重启 ${sup.restarts} 次后放弃，请检查日志后手动启动`;
+            break;
+        case 'exited':
+            text = 'frpc 已退出';
+            break;
+        default:
+            if (!sup.restarts) return '';
+            text = `已自动重启 ${sup.restarts} 次`;
+    }
+    if (sup.lastExit) text += `（${sup.lastExit}）`;
+    return `<div class="config-item"><div class="label">运行状态</div><div class="value">${escapeHtml(text)}</div></div>`;
+}
+
+// === Resource Metrics ===
+let metricsTimer = null;
+
+async function loadMetrics() {
+    clearTimeout(metricsTimer);
+    const id = selectedServerId;
+    const server = servers.find(s => s.id === id);
+    if (!server || !server.running) {
+        renderMetrics(null);
+        return;
+    }
+    try {
+        const data = await api('GET', `/servers/${id}/status`);
+        if (id !== selectedServerId) return;
+        renderMetrics(data.metrics);
+    } catch (e) {
+        // ignore
+    }
+    metricsTimer = setTimeout(loadMetrics, 10000);
+}
+
+function renderMetrics(metrics) {
+    const el = document.getElementById('server-metrics');
+    if (!metrics) {
+        el.classList.add('hidden');
+        el.innerHTML = '';
+        return;
+    }
+    const cur = metrics.current;
+    const hist = metrics.history || [];
+    const item = (label, value, key) => `
+        <div class="config-item">
+            <div class="label">${label}</div>
+            <div class="value">${escapeHtml(value)}</div>
+            ${key ? sparkline(hist.map(m => m[key]).filter(v => v != null)) : ''}
+        </div>`;
+    el.innerHTML =
+        item('CPU', cur.cpuPercent == null ? '—' : `${cur.cpuPercent.toFixed(1)}%`, 'cpuPercent') +
+        item('内存', formatBytes(cur.rssBytes), 'rssBytes') +
+        item('连接数', String(cur.connections), 'connections') +
+        item('文件描述符', String(cur.openFiles), 'openFiles') +
+        item('线程', String(cur.threads)) +
+        item('运行时长', formatDuration(cur.uptimeSeconds));
+    el.classList.remove('hidden');
+}
+
+function sparkline(values) {
+    if (values.length < 2) return '';
+    const max = Math.max(...values) || 1;
+    const points = values.map((v, i) =>
+        `${(i / (values.length - 1) * 100).toFixed(1)},${(24 - v / max * 22).toFixed(1)}`).join(' ');
+    return `<svg class="sparkline" viewBox="0 0 100 24" preserveAspectRatio="none"><polyline points="${points}"/></svg>`;
+}
+
+function formatBytes(n) {
+    if (n < 1024) return `${n} B`;
+    if (n < 1024 * 1024) return `${(n / 1024).toFixed(1)} KB`;
+    return `${(n / 1024 / 1024).toFixed(1)} MB`;
+}
+
+function formatDuration(s) {
+    const d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+    if (d) return `${d} 天 ${h} 小时`;
+    if (h) return `${h} 小时 ${m} 分钟`;
+    return `${m} 分 ${s % 60} 秒`;
 }
 
 // === Proxy Table ===
@@ -276,6 +428,9 @@ function renderProxyTable(proxies) {
                 <td>${escapeHtml(p.localIP || '127.0.0.1')}:${p.localPort}</td>
                 <td>${escapeHtml(remote)}</td>
                 <td>
+                    <button class="btn btn-sm btn-ghost" onclick="probeProxy('${p.id}')" title="检测本地服务">
+                        <svg width="12" height="12" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2"><polyline points="22 12 18 12 15 21 9 3 6 12 2 12"/></svg>
+                    </button>
                     <button class="btn btn-sm btn-ghost" onclick="editProxy('${p.id}')" title="编辑">
                         <svg width="12" height="12" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2"><path d="M11 4H4a2 2 0 00-2 2v14a2 2 0 002 2h14a2 2 0 002-2v-7"/><path d="M18.5 2.5a2.12 2.12 0 013 3L12 15l-4 1 1-4 9.5-9.5z"/></svg>
                     </button>
@@ -293,6 +448,8 @@ document.getElementById('btn-add-server').addEventListener('click', () => {
     editingServerId = null;
     document.getElementById('modal-server-title').textContent = '添加服务器';
     document.getElementById('server-form').reset();
+    document.getElementById('sf-token').placeholder = '可选';
+    document.getElementById('sf-token-clear-group').classList.add('hidden');
     openModal('modal-server');
 });
 
@@ -301,13 +458,21 @@ document.getElementById('btn-edit-server').addEventListener('click', () => {
     if (!server) return;
 
     editingServerId = server.id;
+    editingRevision = server.revision;
     document.getElementById('modal-server-title').textContent = '编辑服务器';
     document.getElementById('sf-name').value = server.name;
     document.getElementById('sf-addr').value = server.serverAddr;
     document.getElementById('sf-port').value = server.serverPort;
-    document.getElementById('sf-token').value = server.authToken || '';
+    document.getElementById('sf-token').value = '';
+    document.getElementById('sf-token').placeholder = server.authTokenStatus === 'set' ? '已设置，留空保持不变' : '可选';
+    document.getElementById('sf-token-clear').checked = false;
+    document.getElementById('sf-token-clear-group').classList.toggle('hidden', server.authTokenStatus !== 'set');
     document.getElementById('sf-user').value = server.user || '';
     document.getElementById('sf-tls').checked = server.tlsEnable || false;
+    document.getElementById('sf-protocol').value = server.protocol || '';
+    document.getElementById('sf-apply-policy').value = server.applyPolicy || '';
+    document.getElementById('sf-restart-policy').value = server.restartPolicy || '';
+    document.getElementById('sf-max-restarts').value = server.maxRestarts || '';
     openModal('modal-server');
 });
 
@@ -320,11 +485,18 @@ document.getElementById('server-form').addEventListener('submit', async (e) => {
         authToken: document.getElementById('sf-token').value,
         user: document.getElementById('sf-user').value,
         tlsEnable: document.getElementById('sf-tls').checked,
+        protocol: document.getElementById('sf-protocol').value,
+        applyPolicy: document.getElementById('sf-apply-policy').value,
+        restartPolicy: document.getElementById('sf-restart-policy').value,
+        maxRestarts: parseInt(document.getElementById('sf-max-restarts').value) || 0,
     };
+    if (editingServerId && document.getElementById('sf-token-clear').checked) {
+        data.clearAuthToken = true;
+    }
 
     try {
         if (editingServerId) {
-            await api('PUT', `/servers/${editingServerId}`, data);
+            await api('PUT', `/servers/${editingServerId}`, data, editingRevision);
             toast('服务器已更新', 'success');
         } else {
             await api('POST', '/servers', data);
@@ -344,7 +516,7 @@ document.getElementById('btn-delete-server').addEventListener('click', async ()
     if (!confirm(`确定删除服务器 "${server.name}" 吗？`)) return;
 
     try {
-        await api('DELETE', `/servers/${selectedServerId}`);
+        await api('DELETE', `/servers/${selectedServerId}`, null, server.revision);
         toast('服务器已删除', 'success');
         selectedServerId = null;
         await loadServers();
@@ -355,6 +527,66 @@ document.getElementById('btn-delete-server').addEventListener('click', async ()
     }
 });
 
+// === Preview Config ===
+document.getElementById('btn-preview-server').addEventListener('click', async () => {
+    if (!selectedServerId) return;
+    try {
+        const data = await api('GET', `/servers/${selectedServerId}/preview`);
+        showingLogs = false;
+        const viewer = document.getElementById('log-viewer');
+        viewer.textContent = data.toml;
+        viewer.scrollTop = 0;
+        if (data.missing && data.missing.length) {
+            toast('未解析的占位符: ' + data.missing.join(', '), 'error');
+        }
+    } catch (e) {
+        toast(e.message, 'error');
+    }
+});
+
+// === Apply Pending Changes ===
+document.getElementById('btn-apply-server').addEventListener('click', async () => {
+    if (!selectedServerId) return;
+    try {
+        const data = await api('GET', `/servers/${selectedServerId}/pending`);
+        showingLogs = false;
+        const viewer = document.getElementById('log-viewer');
+        viewer.textContent = data.diff || '运行中的配置已是最新';
+        viewer.scrollTop = 0;
+        if (!data.configDirty) {
+            await loadServers();
+            renderServerDetail();
+            return;
+        }
+        if (!confirm('将以上配置更改应用到运行中的 frpc 吗？')) return;
+        const res = await api('POST', `/servers/${selectedServerId}/apply`);
+        toast(res.mode === 'reload' ? '配置已热重载' : '配置已应用，frpc 已重启', 'success');
+        await loadServers();
+        renderServerDetail();
+    } catch (e) {
+        toast(e.message, 'error');
+    }
+});
+
+// === Diagnose Server ===
+document.getElementById('btn-diagnose-server').addEventListener('click', async () => {
+    if (!selectedServerId) return;
+    toast('正在诊断连接...', 'info');
+    try {
+        const report = await api('POST', `/servers/${selectedServerId}/diagnose`);
+        const lines = report.steps.map(s => {
+            const mark = { ok: '✔', warn: '!', fail: '✘', skip: '-' }[s.status] || '?';
+            return `${mark} ${s.name}: ${s.error || s.detail || s.status}`;
+        });
+        showingLogs = false;
+        const viewer = document.getElementById('log-viewer');
+        viewer.textContent = `诊断 ${report.serverAddr}:${report.serverPort} (${report.protocol})\n` + lines.join('\n');
+        toast(report.ok ? '连接诊断通过' : `诊断失败于 ${report.failedStep}`, report.ok ? 'success' : 'error');
+    } catch (e) {
+        toast(e.message, 'error');
+    }
+});
+
 // === Start/Stop Server ===
 document.getElementById('btn-toggle-server').addEventListener('click', async () => {
     const server = servers.find(s => s.id === selectedServerId);
@@ -382,8 +614,38 @@ document.getElementById('btn-add-proxy').addEventListener('click', () => {
     document.getElementById('proxy-form').reset();
     document.getElementById('pf-local-ip').value = '127.0.0.1';
     document.getElementById('pf-type').value = 'tcp';
+    document.getElementById('pf-discover-group').classList.remove('hidden');
     toggleProxyFields();
     openModal('modal-proxy');
+    loadDiscoveredServices();
+});
+
+let discoveredServices = [];
+
+async function loadDiscoveredServices() {
+    const select = document.getElementById('pf-discover');
+    select.innerHTML = '<option value="">正在扫描本机端口...</option>';
+    try {
+        discoveredServices = (await api('GET', '/discover/services')).filter(s => !s.exposed);
+    } catch (e) {
+        discoveredServices = [];
+    }
+    select.innerHTML = '<option value="">从本机监听端口中选择（可选）</option>' + discoveredServices.map((s, i) =>
+        `<option value="${i}">${s.protocol.toUpperCase()} ${s.port}${s.process ? ' - ' + escapeHtml(s.process) : ''} (${s.suggestedType})</option>`
+    ).join('');
+}
+
+document.getElementById('pf-discover').addEventListener('change', (e) => {
+    const svc = discoveredServices[e.target.value];
+    if (!svc) return;
+    const nameEl = document.getElementById('pf-name');
+    if (!nameEl.value) nameEl.value = svc.process ? `${svc.process}-${svc.port}` : `port-${svc.port}`;
+    document.getElementById('pf-type').value = svc.suggestedType;
+    document.getElementById('pf-local-port').value = svc.port;
+    if (svc.address === '127.0.0.1' || svc.address === '::1') {
+        document.getElementById('pf-local-ip').value = svc.address;
+    }
+    toggleProxyFields();
 });
 
 document.getElementById('pf-type').addEventListener('change', toggleProxyFields);
@@ -409,7 +671,9 @@ function editProxy(proxyId) {
     if (!proxy) return;
 
     editingProxyId = proxyId;
+    editingRevision = proxy.revision;
     document.getElementById('modal-proxy-title').textContent = '编辑规则';
+    document.getElementById('pf-discover-group').classList.add('hidden');
     document.getElementById('pf-name').value = proxy.name;
     document.getElementById('pf-type').value = proxy.type;
     document.getElementById('pf-local-ip').value = proxy.localIP || '127.0.0.1';
@@ -421,10 +685,29 @@ function editProxy(proxyId) {
     openModal('modal-proxy');
 }
 
+async function probeProxy(proxyId) {
+    try {
+        const r = await api('POST', `/servers/${selectedServerId}/proxies/${proxyId}/probe`);
+        if (!r.reachable) {
+            toast(`${r.target} 不可达: ${r.error}`, 'error');
+            return;
+        }
+        let msg = `${r.target} 可达 (${r.latencyMs.toFixed(1)} ms)`;
+        if (r.httpStatus) msg += `, HTTP ${r.httpStatus}`;
+        if (r.httpError) msg += `, HTTP 请求失败: ${r.httpError}`;
+        if (r.tls) msg += `, 证书${r.tls.verified ? '有效' : '未通过校验'}，${r.tls.expiresInDays} 天后过期`;
+        toast(msg, r.httpError ? 'error' : 'success');
+    } catch (e) {
+        toast(e.message, 'error');
+    }
+}
+
 async function deleteProxy(proxyId) {
     if (!confirm('确定删除此规则吗？')) return;
     try {
-        await api('DELETE', `/servers/${selectedServerId}/proxies/${proxyId}`);
+        const server = servers.find(s => s.id === selectedServerId);
+        const proxy = server && server.proxies.find(p => p.id === proxyId);
+        await api('DELETE', `/servers/${selectedServerId}/proxies/${proxyId}`, null, proxy ? proxy.revision : null);
         toast('规则已删除', 'success');
         await loadServers();
         renderServerDetail();
@@ -456,7 +739,7 @@ document.getElementById('proxy-form').addEventListener('submit', async (e) => {
 
     try {
         if (editingProxyId) {
-            await api('PUT', `/servers/${selectedServerId}/proxies/${editingProxyId}`, data);
+            await api('PUT', `/servers/${selectedServerId}/proxies/${editingProxyId}`, data, editingRevision);
             toast('规则已更新', 'success');
         } else {
             await api('POST', `/servers/${selectedServerId}/proxies`, data);
@@ -471,7 +754,51 @@ document.getElementById('proxy-form').addEventListener('submit', async (e) => {
 });
 
 // === Logs ===
-document.getElementById('btn-refresh-logs').addEventListener('click', refreshLogs);
+// Logs are streamed over Server-Sent Events; the viewer also shows config
+// previews, during which new lines are only collected
+let logStream = null;
+let logStreamServerId = null;
+let logLines = [];
+let showingLogs = true;
+
+document.getElementById('btn-refresh-logs').addEventListener('click', () => followLogs(true));
+
+function followLogs(restart = false) {
+    if (!selectedServerId) return;
+    if (!window.EventSource) {
+        refreshLogs();
+        return;
+    }
+    if (logStream && logStreamServerId === selectedServerId && !restart) return;
+
+    stopLogStream();
+    logLines = [];
+    showingLogs = true;
+    renderLogs();
+    logStreamServerId = selectedServerId;
+    logStream = new EventSource(`/api/servers/${selectedServerId}/logs/stream`);
+    logStream.addEventListener('reset', () => {
+        logLines = [];
+    });
+    logStream.onmessage = (e) => {
+        logLines.push(e.data);
+        if (logLines.length > 1000) logLines.splice(0, logLines.length - 1000);
+        if (showingLogs) renderLogs();
+    };
+}
+
+function stopLogStream() {
+    if (logStream) logStream.close();
+    logStream = null;
+    logStreamServerId = null;
+}
+
+function renderLogs() {
+    const viewer = document.getElementById('log-viewer');
+    const atBottom = viewer.scrollTop + viewer.clientHeight >= viewer.scrollHeight - 20;
+    viewer.textContent = logLines.length ? logLines.join('\n') : '暂无日志';
+    if (atBottom) viewer.scrollTop = viewer.scrollHeight;
+}
 
 async function refreshLogs() {
     if (!selectedServerId) return;
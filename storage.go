@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Storage persists the server list. Servers are passed with secrets already
+// sealed; implementations never see plain-text tokens.
+type Storage interface {
+	// Load returns the stored servers, or an empty list if none were saved
+	Load() ([]ServerConfig, error)
+	// Save atomically replaces the stored servers
+	Save(servers []ServerConfig) error
+	Close() error
+}
+
+// storageBackends lists the values accepted by STORAGE_BACKEND
+var storageBackends = []string{"json", "kv"}
+
+// openStorage opens the named backend in dataDir
+func openStorage(backend, dataDir string) (Storage, error) {
+	switch backend {
+	case "json":
+		return NewJSONStorage(filepath.Join(dataDir, "servers.json")), nil
+	case "kv":
+		return OpenKVStorage(filepath.Join(dataDir, "servers.kv"))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (supported: %v)", backend, storageBackends)
+	}
+}
+
+// JSONStorage keeps all servers in one JSON file that is rewritten on
+// every save
+type JSONStorage struct {
+	path string
+
+	// What this process last read or wrote, to tell external edits apart
+	seenHash  [32]byte
+	seenMtime time.Time
+	seenSize  int64
+	mu        sync.Mutex
+}
+
+func NewJSONStorage(path string) *JSONStorage {
+	return &JSONStorage{path: path}
+}
+
+func (js *JSONStorage) Load() ([]ServerConfig, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var servers []ServerConfig
+	if err := readJSONFile(js.path, &servers); err != nil {
+		if os.IsNotExist(err) {
+			return []ServerConfig{}, nil
+		}
+		return nil, err
+	}
+	if servers == nil {
+		servers = []ServerConfig{}
+	}
+	if b, err := os.ReadFile(js.path); err == nil {
+		js.markSeen(b)
+	}
+	return servers, nil
+}
+
+func (js *JSONStorage) Save(servers []ServerConfig) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	b, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(js.path, b, 0600); err != nil {
+		return err
+	}
+	js.markSeen(b)
+	return nil
+}
+
+func (js *JSONStorage) markSeen(b []byte) {
+	js.seenHash = sha256.Sum256(b)
+	if info, err := os.Stat(js.path); err == nil {
+		js.seenMtime, js.seenSize = info.ModTime(), info.Size()
+	}
+}
+
+// ReadIfChanged returns the file content if it differs from what this
+// process last read or wrote. The mtime and size are checked first so an
+// unchanged file is not read. The returned content counts as seen.
+func (js *JSONStorage) ReadIfChanged() ([]byte, bool, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	info, err := os.Stat(js.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if info.ModTime().Equal(js.seenMtime) && info.Size() == js.seenSize {
+		return nil, false, nil
+	}
+	b, err := os.ReadFile(js.path)
+	if err != nil {
+		return nil, false, err
+	}
+	hash := sha256.Sum256(b)
+	js.seenMtime, js.seenSize = info.ModTime(), info.Size()
+	if hash == js.seenHash {
+		return nil, false, nil
+	}
+	js.seenHash = hash
+	return b, true, nil
+}
+
+func (js *JSONStorage) Close() error {
+	return nil
+}
+
+// convertStorage copies all servers from one backend to another. The
+// target must be empty so nothing is overwritten by accident.
+func convertStorage(dataDir, from, to string) (int, error) {
+	if from == to {
+		return 0, fmt.Errorf("source and target backend are the same")
+	}
+	src, err := openStorage(from, dataDir)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := openStorage(to, dataDir)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	existing, err := dst.Load()
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, fmt.Errorf("target backend %s already holds %d servers", to, len(existing))
+	}
+	servers, err := src.Load()
+	if err != nil {
+		return 0, err
+	}
+	if err := dst.Save(servers); err != nil {
+		return 0, err
+	}
+	return len(servers), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Restart policies decide whether frpc is restarted after it exits on its
+// own
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure" // default; restart after a non-zero exit
+	restartAlways    = "always"
+)
+
+// Supervisor states reported by the API
+const (
+	stateRunning   = "running"
+	stateStopped   = "stopped"    // stopped by the user, or never started
+	stateExited    = "exited"     // exited and not restarted per policy
+	stateBackoff   = "backoff"    // waiting to be restarted
+	stateCrashLoop = "crash-loop" // gave up after too many restarts
+)
+
+const (
+	defaultMaxRestarts = 10
+	restartBackoffMin  = time.Second
+	restartBackoffMax  = 5 * time.Minute
+	// stableUptime is how long frpc must run before earlier crashes no
+	// longer count towards the restart limit
+	stableUptime = 10 * time.Minute
+)
+
+// SupervisorStatus describes the supervision of one server's frpc
+type SupervisorStatus struct {
+	State       string `json:"state"`
+	Restarts    int    `json:"restarts"` // automatic restarts since the last manual start
+	LastExit    string `json:"lastExit,omitempty"`
+	NextRestart string `json:"nextRestart,omitempty"`
+}
+
+// restartBackoff returns the delay before restart attempt n+1
+func restartBackoff(n int) time.Duration {
+	d := restartBackoffMin
+	for i := 0; i < n && d < restartBackoffMax; i++ {
+		d *= 2
+	}
+	if d > restartBackoffMax {
+		d = restartBackoffMax
+	}
+	return d
+}
+
+// configFor returns the config to restart a process with
+func (pm *ProcessManager) configFor(info *ProcessInfo) (string, error) {
+	if pm.serverConfig == nil {
+		return info.Toml, nil
+	}
+	return pm.serverConfig(info.ServerID)
+}
+
+func (pm *ProcessManager) policyFor(serverID string) (string, int) {
+	if pm.restartPolicy == nil {
+		return restartNever, 0
+	}
+	return pm.restartPolicy(serverID)
+}
+
+// monitor waits for frpc to exit and, unless it was stopped on purpose,
+// schedules a restart according to the server's policy
+func (pm *ProcessManager) monitor(info *ProcessInfo) {
+	err := info.wait()
+	pm.removePIDFile(info)
+	// Done before a new process of the server can start following the log
+	if info.follower != nil {
+		info.follower.Close()
+	}
+	close(info.done)
+	uptime := time.Since(info.StartedAt)
+	policy, maxRestarts := pm.policyFor(info.ServerID)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.processes[info.ServerID] != info || !info.Running {
+		log.Printf("frpc process for server %s exited", info.ServerID)
+		return
+	}
+	info.Running = false
+	info.LastExit = "exit status 0"
+	if err != nil {
+		info.LastExit = err.Error()
+	}
+	pm.conns.Exited(info.ServerID, err)
+	log.Printf("frpc process for server %s exited unexpectedly after %s: %s", info.ServerID, uptime.Round(time.Second), info.LastExit)
+
+	if policy == restartNever || (policy == restartOnFailure && err == nil) {
+		info.State = stateExited
+		return
+	}
+	if uptime >= stableUptime {
+		info.Restarts = 0
+	}
+	pm.scheduleRestart(info, maxRestarts)
+}
+
+// scheduleRestart arms the backoff timer, or gives up once the server has
+// used up its restarts. pm.mu must be held.
+func (pm *ProcessManager) scheduleRestart(info *ProcessInfo, maxRestarts int) {
+	if info.Restarts >= maxRestarts {
+		info.State = stateCrashLoop
+		log.Printf("frpc for server %s keeps exiting, giving up after %d restarts", info.ServerID, info.Restarts)
+		return
+	}
+	delay := restartBackoff(info.Restarts)
+	info.State = stateBackoff
+	info.NextRestart = time.Now().Add(delay)
+	info.restartTimer = time.AfterFunc(delay, func() { pm.restart(info) })
+	log.Printf("Restarting frpc for server %s in %s (attempt %d of %d)", info.ServerID, delay, info.Restarts+1, maxRestarts)
+}
+
+// restart starts frpc again with the server's current config, so that a
+// fix made during the backoff is picked up
+func (pm *ProcessManager) restart(prev *ProcessInfo) {
+	policy, maxRestarts := pm.policyFor(prev.ServerID)
+	toml, configErr := pm.configFor(prev)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	// A manual start or stop got there first
+	if pm.closed || pm.processes[prev.ServerID] != prev || prev.State != stateBackoff {
+		return
+	}
+	prev.restartTimer = nil
+	if policy == restartNever {
+		prev.State = stateExited
+		return
+	}
+
+	prev.Restarts++
+	if configErr != nil {
+		log.Printf("Cannot restart frpc for server %s: %v", prev.ServerID, configErr)
+		prev.LastExit = configErr.Error()
+		pm.scheduleRestart(prev, maxRestarts)
+		return
+	}
+	if _, err := pm.spawn(prev.ServerID, toml, prev); err != nil {
+		log.Printf("Failed to restart frpc for server %s: %v", prev.ServerID, err)
+		prev.LastExit = err.Error()
+		pm.scheduleRestart(prev, maxRestarts)
+	}
+}
+
+// Supervision returns the supervisor state of a server
+func (pm *ProcessManager) Supervision(serverID string) SupervisorStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	info, ok := pm.processes[serverID]
+	if !ok {
+		return SupervisorStatus{State: stateStopped}
+	}
+	status := SupervisorStatus{State: info.State, Restarts: info.Restarts, LastExit: info.LastExit}
+	if info.State == stateBackoff {
+		status.NextRestart = info.NextRestart.Format(time.RFC3339)
+	}
+	return status
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	hostnameRe  = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+	subdomainRe = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// FieldError describes one invalid field. Code is machine-readable:
+// required, invalid, out_of_range, not_allowed or duplicate.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every problem found in one object
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, code, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// result returns e as an error, or nil when nothing was added
+func (e *ValidationError) result() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateServer checks the server's own settings; proxies are validated
+// separately through validateProxy
+func validateServer(cfg *ServerConfig) error {
+	v := &ValidationError{}
+
+	if cfg.Name == "" {
+		v.add("name", "required", "name is required")
+	} else {
+		checkTomlString(v, "name", cfg.Name)
+	}
+
+	switch {
+	case cfg.ServerAddr == "":
+		v.add("serverAddr", "required", "serverAddr is required")
+	case !validHost(cfg.ServerAddr):
+		v.add("serverAddr", "invalid", "serverAddr must be an IP address or hostname")
+	}
+
+	checkPort(v, "serverPort", cfg.ServerPort, true)
+	checkTomlString(v, "authToken", cfg.AuthToken)
+	checkTomlString(v, "user", cfg.User)
+
+	switch cfg.AuthMethod {
+	case "", "token", "oidc":
+	default:
+		v.add("authMethod", "invalid", "authMethod must be token or oidc")
+	}
+
+	switch cfg.ApplyPolicy {
+	case "", applyManual, applyRestart, applyReload:
+	default:
+		v.add("applyPolicy", "invalid", "applyPolicy must be manual, restart or reload")
+	}
+
+	switch cfg.RestartPolicy {
+	case "", restartNever, restartOnFailure, restartAlways:
+	default:
+		v.add("restartPolicy", "invalid", "restartPolicy must be never, on-failure or always")
+	}
+	if cfg.MaxRestarts < 0 || cfg.MaxRestarts > 1000 {
+		v.add("maxRestarts", "out_of_range", "maxRestarts must be between 0 and 1000")
+	}
+
+	switch cfg.Protocol {
+	case "", "tcp", "kcp", "quic", "websocket", "wss":
+	default:
+		v.add("protocol", "invalid", "protocol must be one of tcp, kcp, quic, websocket, wss")
+	}
+
+	return v.result()
+}
+
+// validateProxy checks p against the rules for its type. server, if not nil,
+// is the server p belongs to and is used to detect conflicts with the
+// server's other proxies.
+func validateProxy(p *ProxyConfig, server *ServerConfig) error {
+	v := &ValidationError{}
+
+	if p.Name == "" {
+		v.add("name", "required", "name is required")
+	} else {
+		checkTomlString(v, "name", p.Name)
+	}
+
+	if p.LocalIP != "" && !validHost(p.LocalIP) {
+		v.add("localIP", "invalid", "localIP must be an IP address or hostname")
+	}
+	checkPort(v, "localPort", p.LocalPort, true)
+
+	switch p.Type {
+	case "":
+		v.add("type", "required", "type is required")
+	case "tcp", "udp":
+		checkPort(v, "remotePort", p.RemotePort, false)
+		if len(p.CustomDomains) > 0 {
+			v.add("customDomains", "not_allowed", "customDomains only apply to http and https proxies")
+		}
+		if p.Subdomain != "" {
+			v.add("subdomain", "not_allowed", "subdomain only applies to http and https proxies")
+		}
+	case "http", "https":
+		if p.RemotePort != 0 {
+			v.add("remotePort", "not_allowed", "remotePort only applies to tcp and udp proxies")
+		}
+		if len(p.CustomDomains) == 0 && p.Subdomain == "" {
+			v.add("customDomains", "required", "%s proxies need customDomains or a subdomain", p.Type)
+		}
+		for i, d := range p.CustomDomains {
+			if !hasPlaceholder(d) && !hostnameRe.MatchString(strings.TrimPrefix(d, "*.")) {
+				v.add(fmt.Sprintf("customDomains[%d]", i), "invalid", "%q is not a valid domain", d)
+			}
+		}
+		if p.Subdomain != "" && !hasPlaceholder(p.Subdomain) && !subdomainRe.MatchString(p.Subdomain) {
+			v.add("subdomain", "invalid", "subdomain must be a single DNS label")
+		}
+	default:
+		v.add("type", "invalid", "type must be one of tcp, udp, http, https")
+	}
+
+	if server != nil {
+		for _, other := range server.Proxies {
+			if other.ID == p.ID {
+				continue
+			}
+			if p.Name != "" && other.Name == p.Name {
+				v.add("name", "duplicate", "server already has a proxy named %s", p.Name)
+			}
+			if p.RemotePort != 0 && other.RemotePort == p.RemotePort && proxyTransport(other.Type) == proxyTransport(p.Type) {
+				v.add("remotePort", "duplicate", "remote port %d is already used by proxy %s", p.RemotePort, other.Name)
+			}
+		}
+	}
+
+	return v.result()
+}
+
+// validateRendered checks the values placeholders were replaced with,
+// which validateServer and validateProxy let through unchecked
+func validateRendered(r *ServerConfig) error {
+	v := &ValidationError{}
+
+	checkTomlString(v, "serverAddr", r.ServerAddr)
+	if !validHost(r.ServerAddr) {
+		v.add("serverAddr", "invalid", "serverAddr must be an IP address or hostname")
+	}
+	checkTomlString(v, "authToken", r.AuthToken)
+	checkTomlString(v, "user", r.User)
+
+	for i, p := range r.Proxies {
+		field := fmt.Sprintf("proxies[%d].", i)
+		checkTomlString(v, field+"name", p.Name)
+		checkTomlString(v, field+"localIP", p.LocalIP)
+		if p.LocalIP != "" && !validHost(p.LocalIP) {
+			v.add(field+"localIP", "invalid", "localIP must be an IP address or hostname")
+		}
+		for j, d := range p.CustomDomains {
+			if !hasPlaceholder(d) && !hostnameRe.MatchString(strings.TrimPrefix(d, "*.")) {
+				v.add(fmt.Sprintf("%scustomDomains[%d]", field, j), "invalid", "%q is not a valid domain", d)
+			}
+		}
+		if p.Subdomain != "" && !hasPlaceholder(p.Subdomain) && !subdomainRe.MatchString(p.Subdomain) {
+			v.add(field+"subdomain", "invalid", "subdomain must be a single DNS label")
+		}
+	}
+
+	return v.result()
+}
+
+func checkPort(v *ValidationError, field string, port int, required bool) {
+	switch {
+	case port == 0 && required:
+		v.add(field, "required", "%s is required", field)
+	case port < 0 || port > 65535:
+		v.add(field, "out_of_range", "%s must be between 1 and 65535", field)
+	}
+}
+
+// checkTomlString rejects characters that formatToml cannot quote
+func checkTomlString(v *ValidationError, field, s string) {
+	if strings.ContainsAny(s, "\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		v.add(field, "invalid", "%s must not contain quotes, backslashes or control characters", field)
+	}
+}
+
+// validHost accepts IP addresses and RFC 1123 hostnames, including single
+// labels such as Docker service names or LAN hosts like "nas". Values with
+// placeholders are checked by validateRendered once they are rendered.
+func validHost(s string) bool {
+	if hasPlaceholder(s) || net.ParseIP(s) != nil {
+		return true
+	}
+	return len(s) <= 253 && hostnameRe.MatchString(s)
+}
+
+func hasPlaceholder(s string) bool {
+	return strings.Contains(s, "{{")
+}
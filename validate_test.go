@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"localhost", true},
+		{"nas", true},
+		{"redis", true},
+		{"my-app_1", false},
+		{"frps.example.com", true},
+		{"{{ .Vars.HOST }}", true},
+		{"", false},
+		{"-nas", false},
+		{"nas-", false},
+		{"a..b", false},
+		{"a b", false},
+		{`nas"`, false},
+		{"nas\n[webServer]", false},
+	}
+	for _, tt := range tests {
+		if got := validHost(tt.host); got != tt.want {
+			t.Errorf("validHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestValidateProxy(t *testing.T) {
+	server := &ServerConfig{Proxies: []ProxyConfig{
+		{ID: "p1", Name: "ssh", Type: "tcp", LocalPort: 22, RemotePort: 6000},
+		{ID: "p2", Name: "dns", Type: "udp", LocalPort: 53, RemotePort: 6053},
+	}}
+	tcp := func(edit func(p *ProxyConfig)) ProxyConfig {
+		p := ProxyConfig{ID: "new", Name: "web", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 80, RemotePort: 8080}
+		edit(&p)
+		return p
+	}
+	http := func(edit func(p *ProxyConfig)) ProxyConfig {
+		p := ProxyConfig{ID: "new", Name: "web", Type: "http", LocalIP: "nas", LocalPort: 80, CustomDomains: []string{"a.example.com"}}
+		edit(&p)
+		return p
+	}
+	tests := []struct {
+		name  string
+		proxy ProxyConfig
+		want  []string // field:code
+	}{
+		{"valid tcp", tcp(func(p *ProxyConfig) {}), nil},
+		{"valid http", http(func(p *ProxyConfig) {}), nil},
+		{"wildcard domain", http(func(p *ProxyConfig) { p.CustomDomains = []string{"*.example.com"} }), nil},
+		{"subdomain only", http(func(p *ProxyConfig) { p.CustomDomains = nil; p.Subdomain = "web" }), nil},
+		{"placeholders", http(func(p *ProxyConfig) { p.LocalIP = "{{ .Vars.HOST }}"; p.CustomDomains = []string{"{{ .Vars.DOMAIN }}"} }), nil},
+		{"udp reuses a tcp port", tcp(func(p *ProxyConfig) { p.Type = "udp"; p.RemotePort = 6000 }), nil},
+		{"same proxy keeps its port", tcp(func(p *ProxyConfig) { p.ID = "p1"; p.Name = "ssh"; p.RemotePort = 6000 }), nil},
+		{"missing name and type", tcp(func(p *ProxyConfig) { p.Name = ""; p.Type = "" }), []string{"name:required", "type:required"}},
+		{"unknown type", tcp(func(p *ProxyConfig) { p.Type = "stcp" }), []string{"type:invalid"}},
+		{"quoted name", tcp(func(p *ProxyConfig) { p.Name = `web"` }), []string{"name:invalid"}},
+		{"bad local IP", tcp(func(p *ProxyConfig) { p.LocalIP = "bad host" }), []string{"localIP:invalid"}},
+		{"ports", tcp(func(p *ProxyConfig) { p.LocalPort = 0; p.RemotePort = 70000 }), []string{"localPort:required", "remotePort:out_of_range"}},
+		{"domains on tcp", tcp(func(p *ProxyConfig) { p.CustomDomains = []string{"a.example.com"}; p.Subdomain = "a" }), []string{"customDomains:not_allowed", "subdomain:not_allowed"}},
+		{"remote port on http", http(func(p *ProxyConfig) { p.RemotePort = 8080 }), []string{"remotePort:not_allowed"}},
+		{"http without domain", http(func(p *ProxyConfig) { p.CustomDomains = nil }), []string{"customDomains:required"}},
+		{"bad domain", http(func(p *ProxyConfig) { p.CustomDomains = []string{"a.example.com", "a..b"} }), []string{"customDomains[1]:invalid"}},
+		{"bad subdomain", http(func(p *ProxyConfig) { p.Subdomain = "a.b" }), []string{"subdomain:invalid"}},
+		{"duplicates", tcp(func(p *ProxyConfig) { p.Name = "ssh"; p.RemotePort = 6000 }), []string{"name:duplicate", "remotePort:duplicate"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		if err := validateProxy(&tt.proxy, server); err != nil {
+			for _, fe := range err.(*ValidationError).Errors {
+				got = append(got, fe.Field+":"+fe.Code)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got errors %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	variableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	placeholderRe  = regexp.MustCompile(`\{\{\s*\.(Envs|Vars)\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// Variable is a GUI-level value usable as {{ .Vars.NAME }} in config fields
+type Variable struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Secret bool   `json:"secret"`
+}
+
+// VariableStore persists global variables in variables.json; secret values
+// are encrypted like auth tokens
+type VariableStore struct {
+	dataDir string
+	secrets *SecretStore
+	// The decrypted variables as of the file version in cachedInfo, so that
+	// rendering every server's config does not read and decrypt the file
+	cached     []Variable
+	cachedInfo os.FileInfo
+	// retired holds secret values replaced or deleted in this run, which
+	// configs generated earlier may still contain
+	retired map[string]bool
+	mu      sync.Mutex
+}
+
+func NewVariableStore(dataDir string, secrets *SecretStore) *VariableStore {
+	return &VariableStore{dataDir: dataDir, secrets: secrets, retired: make(map[string]bool)}
+}
+
+func (vs *VariableStore) filePath() string {
+	return filepath.Join(vs.dataDir, "variables.json")
+}
+
+// load returns the variables, from the cache while the file has not been
+// replaced or modified. vs.mu must be held.
+func (vs *VariableStore) load() ([]Variable, error) {
+	info, err := os.Stat(vs.filePath())
+	if err == nil && vs.cachedInfo != nil && os.SameFile(info, vs.cachedInfo) &&
+		info.ModTime().Equal(vs.cachedInfo.ModTime()) && info.Size() == vs.cachedInfo.Size() {
+		return append([]Variable(nil), vs.cached...), nil
+	}
+
+	var vars []Variable
+	if err := readJSONFile(vs.filePath(), &vars); err != nil {
+		if os.IsNotExist(err) {
+			return []Variable{}, nil
+		}
+		return nil, err
+	}
+	for i := range vars {
+		if !vars[i].Secret {
+			continue
+		}
+		value, err := vs.secrets.Decrypt(vars[i].Value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %v", vars[i].Name, err)
+		}
+		vars[i].Value = value
+	}
+	if info != nil {
+		vs.cached, vs.cachedInfo = append([]Variable(nil), vars...), info
+	}
+	return vars, nil
+}
+
+func (vs *VariableStore) save(vars []Variable) error {
+	sealed := make([]Variable, len(vars))
+	copy(sealed, vars)
+	for i := range sealed {
+		if !sealed[i].Secret {
+			continue
+		}
+		value, err := vs.secrets.Encrypt(sealed[i].Value)
+		if err != nil {
+			return err
+		}
+		sealed[i].Value = value
+	}
+
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i].Name < sealed[j].Name })
+	b, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	vs.cachedInfo = nil
+	return writeJSONFile(vs.filePath(), b, 0600)
+}
+
+// List returns all variables with their plain values
+func (vs *VariableStore) List() ([]Variable, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.load()
+}
+
+// Values returns the variables as a name to value map
+func (vs *VariableStore) Values() (map[string]string, error) {
+	vars, err := vs.List()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(vars))
+	for _, v := range vars {
+		values[v.Name] = v.Value
+	}
+	return values, nil
+}
+
+// MaskedValues is Values with the values of secret variables hidden
+func (vs *VariableStore) MaskedValues() (map[string]string, error) {
+	vars, err := vs.List()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(vars))
+	for _, v := range vars {
+		values[v.Name] = v.Value
+		if v.Secret {
+			values[v.Name] = "******"
+		}
+	}
+	return values, nil
+}
+
+// SecretValues returns the values secret variables have, or had earlier in
+// this run, so that they can be hidden in generated config
+func (vs *VariableStore) SecretValues() ([]string, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vars, err := vs.load()
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, v := range vars {
+		if v.Secret && v.Value != "" {
+			values = append(values, v.Value)
+		}
+	}
+	for v := range vs.retired {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// Set creates or replaces a variable. An empty value for an existing secret
+// keeps the stored one, since secret values are never sent to clients.
+func (vs *VariableStore) Set(v Variable) error {
+	if !variableNameRe.MatchString(v.Name) {
+		return fmt.Errorf("invalid variable name %q", v.Name)
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vars, err := vs.load()
+	if err != nil {
+		return err
+	}
+	for i := range vars {
+		if vars[i].Name == v.Name {
+			if v.Secret && vars[i].Secret && v.Value == "" {
+				v.Value = vars[i].Value
+			}
+			if vars[i].Secret && vars[i].Value != "" && (v.Value != vars[i].Value || !v.Secret) {
+				vs.retired[vars[i].Value] = true
+			}
+			vars[i] = v
+			return vs.save(vars)
+		}
+	}
+	return vs.save(append(vars, v))
+}
+
+func (vs *VariableStore) Delete(name string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vars, err := vs.load()
+	if err != nil {
+		return err
+	}
+	for i := range vars {
+		if vars[i].Name == name {
+			if vars[i].Secret && vars[i].Value != "" {
+				vs.retired[vars[i].Value] = true
+			}
+			return vs.save(append(vars[:i], vars[i+1:]...))
+		}
+	}
+	return fmt.Errorf("variable not found: %s", name)
+}
+
+// renderPlaceholders substitutes {{ .Vars.NAME }} from vars and, when
+// expandEnvs is set, {{ .Envs.NAME }} from the environment. Placeholders
+// that cannot be resolved are left in place and reported as missing.
+func renderPlaceholders(s string, vars map[string]string, expandEnvs bool, missing map[string]bool) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+		parts := placeholderRe.FindStringSubmatch(m)
+		kind, name := parts[1], parts[2]
+		switch kind {
+		case "Vars":
+			if v, ok := vars[name]; ok {
+				return v
+			}
+		case "Envs":
+			if !expandEnvs {
+				return m
+			}
+			if v, ok := os.LookupEnv(name); ok {
+				return v
+			}
+		}
+		missing["."+kind+"."+name] = true
+		return m
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVariableStoreCache(t *testing.T) {
+	dir := t.TempDir()
+	secrets, err := NewSecretStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := NewVariableStore(dir, secrets)
+
+	values := func() map[string]string {
+		t.Helper()
+		v, err := vs.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if len(values()) != 0 {
+		t.Fatal("expected no variables")
+	}
+	if err := vs.Set(Variable{Name: "HOST", Value: "nas"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.Set(Variable{Name: "TOKEN", Value: "s3cret", Secret: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v := values(); v["HOST"] != "nas" || v["TOKEN"] != "s3cret" {
+		t.Fatalf("got %v", v)
+	}
+
+	// Callers cannot change the cached values
+	vars, _ := vs.List()
+	vars[0].Value = "changed"
+	if v := values(); v["HOST"] != "nas" {
+		t.Fatalf("cache modified through List: %v", v)
+	}
+
+	// Hand edits of the file are picked up
+	if err := os.WriteFile(vs.filePath(), []byte(`[{"name": "HOST", "value": "router", "secret": false}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v := values(); len(v) != 1 || v["HOST"] != "router" {
+		t.Fatalf("external edit not seen: %v", v)
+	}
+
+	if err := vs.Delete("HOST"); err != nil {
+		t.Fatal(err)
+	}
+	if len(values()) != 0 {
+		t.Fatal("deleted variable still listed")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// externalSource is implemented by storage backends whose data can be
+// edited outside the GUI
+type externalSource interface {
+	ReadIfChanged() ([]byte, bool, error)
+}
+
+// WatchEvent records how an external edit was handled
+type WatchEvent struct {
+	Time    string   `json:"time"`
+	Status  string   `json:"status"` // applied, unchanged, rejected
+	Summary []string `json:"summary"`
+	Errors  []string `json:"errors"`
+	Stopped []string `json:"stopped,omitempty"` // running servers that were removed
+	Pending []string `json:"pending,omitempty"` // running servers left on the old config by the manual policy
+}
+
+// ConfigWatcher polls the config file for edits made by hand or by sync
+// tools. Valid edits are recorded in the history as "external" and reach
+// running servers through their apply policy like any other change, so
+// servers with the manual policy keep the old config until applied by hand.
+// Removed servers are stopped. Invalid edits are logged and ignored, leaving
+// the running config in place.
+type ConfigWatcher struct {
+	config   *ConfigManager
+	applier  *Applier
+	source   externalSource
+	interval time.Duration
+	last     *WatchEvent
+	mu       sync.Mutex
+}
+
+// NewConfigWatcher returns nil if store cannot be edited externally
+func NewConfigWatcher(config *ConfigManager, applier *Applier, store Storage, interval time.Duration) *ConfigWatcher {
+	source, ok := store.(externalSource)
+	if !ok {
+		return nil
+	}
+	return &ConfigWatcher{config: config, applier: applier, source: source, interval: interval}
+}
+
+// Run polls forever
+func (cw *ConfigWatcher) Run() {
+	// Load first so the current file is not mistaken for an edit
+	if _, err := cw.config.Load(); err != nil {
+		log.Printf("Config watcher: %v", err)
+	}
+	ticker := time.NewTicker(cw.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cw.Check()
+	}
+}
+
+// Check looks for an external edit once and handles it
+func (cw *ConfigWatcher) Check() *WatchEvent {
+	b, changed, err := cw.source.ReadIfChanged()
+	if err != nil {
+		log.Printf("Config watcher: %v", err)
+		return nil
+	}
+	if !changed {
+		return nil
+	}
+
+	event := cw.apply(b)
+	switch event.Status {
+	case "rejected":
+		for _, e := range event.Errors {
+			log.Printf("Rejected external config edit: %s", e)
+		}
+	case "applied":
+		for _, line := range event.Summary {
+			log.Printf("External config edit: %s", line)
+		}
+		for _, name := range event.Stopped {
+			log.Printf("Stopped %s after external edit", name)
+		}
+		for _, name := range event.Pending {
+			log.Printf("Server %s has pending changes from external edit", name)
+		}
+	}
+
+	cw.mu.Lock()
+	cw.last = event
+	cw.mu.Unlock()
+	return event
+}
+
+func (cw *ConfigWatcher) apply(b []byte) *WatchEvent {
+	event := &WatchEvent{Time: time.Now().Format(time.RFC3339), Summary: []string{}, Errors: []string{}}
+
+	servers, errs := cw.parse(b)
+	if len(errs) > 0 {
+		event.Status = "rejected"
+		event.Errors = errs
+		return event
+	}
+
+	var before []ServerConfig
+	err := cw.config.UpdateAs("external", "", func(st *State) error {
+		before = cloneServers(st.Servers)
+		event.Summary = summarizeChanges(st.Servers, servers)
+		st.Servers = servers
+		return nil
+	})
+	if err != nil {
+		event.Status = "rejected"
+		event.Errors = []string{err.Error()}
+		return event
+	}
+	if len(event.Summary) == 0 {
+		event.Status = "unchanged"
+		return event
+	}
+
+	// Changes of remaining servers are applied on commit by their policy
+	event.Status = "applied"
+	event.Stopped = cw.applier.StopRemoved(before, servers)
+	for i := range servers {
+		if policy := servers[i].ApplyPolicy; policy == applyRestart || policy == applyReload {
+			continue
+		}
+		if _, _, dirty := cw.applier.Pending(&servers[i]); dirty {
+			event.Pending = append(event.Pending, servers[i].Name)
+		}
+	}
+	return event
+}
+
+// parse decodes and validates edited content. Missing IDs are filled in
+// and plain-text tokens are accepted; both are sealed on the next save.
+func (cw *ConfigWatcher) parse(b []byte) ([]ServerConfig, []string) {
+	var servers []ServerConfig
+	if err := json.Unmarshal(b, &servers); err != nil {
+		return nil, []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	if servers == nil {
+		servers = []ServerConfig{}
+	}
+	if err := cw.config.unseal(servers); err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	var errs []string
+	serverIDs := make(map[string]bool)
+	for i := range servers {
+		s := &servers[i]
+		if s.ID == "" {
+			s.ID = generateID()
+		}
+		if serverIDs[s.ID] {
+			errs = append(errs, fmt.Sprintf("server %s: duplicate id %s", s.Name, s.ID))
+		}
+		serverIDs[s.ID] = true
+		if s.Proxies == nil {
+			s.Proxies = []ProxyConfig{}
+		}
+		errs = append(errs, validationMessages("server "+s.Name, validateServer(s))...)
+
+		proxyIDs := make(map[string]bool)
+		for j := range s.Proxies {
+			p := &s.Proxies[j]
+			if p.ID == "" {
+				p.ID = generateID()
+			}
+			if proxyIDs[p.ID] {
+				errs = append(errs, fmt.Sprintf("server %s: proxy %s: duplicate id %s", s.Name, p.Name, p.ID))
+			}
+			proxyIDs[p.ID] = true
+			errs = append(errs, validationMessages(fmt.Sprintf("server %s: proxy %s", s.Name, p.Name), validateProxy(p, s))...)
+		}
+	}
+	return servers, errs
+}
+
+func validationMessages(prefix string, err error) []string {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		if err != nil {
+			return []string{prefix + ": " + err.Error()}
+		}
+		return nil
+	}
+	msgs := make([]string, len(verr.Errors))
+	for i, fe := range verr.Errors {
+		msgs[i] = fmt.Sprintf("%s: %s: %s", prefix, fe.Field, fe.Message)
+	}
+	return msgs
+}
+
+// Last returns the most recent external edit, or nil
+func (cw *ConfigWatcher) Last() *WatchEvent {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.last
+}